@@ -0,0 +1,118 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+
+	"catchall/internal/keys"
+	"catchall/internal/storage"
+)
+
+const usage = `Specify the address of the master database and a command
+  create [name] [scopes] [ttl]   scopes among events:write,domains:read,admin, ttl such as 720h
+  list
+  revoke [id]`
+
+func main() {
+
+	if len(os.Args) < 3 {
+		fmt.Fprintln(os.Stderr, usage)
+		os.Exit(1)
+	}
+
+	database, err := storage.OpenMongo(os.Args[1])
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "Failed to connect to the master database :", err)
+		os.Exit(1)
+	}
+	store := keys.NewStore(storage.Database(database).Collection("keys"))
+
+	switch args := os.Args[3:]; os.Args[2] {
+	case "create":
+		err = createKey(store, args)
+	case "list":
+		err = listKeys(store)
+	case "revoke":
+		err = revokeKey(store, args)
+	default:
+		fmt.Fprintln(os.Stderr, usage)
+		os.Exit(1)
+	}
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+}
+
+// Create Key - Print the token of the new key, it can't be retrieved later
+func createKey(store *keys.Store, args []string) error {
+
+	if len(args) < 2 {
+		return errors.New(usage)
+	}
+
+	scopes, err := keys.ParseScopes(args[1])
+	if err != nil {
+		return err
+	}
+	var ttl time.Duration
+	if len(args) > 2 {
+		if ttl, err = time.ParseDuration(args[2]); err != nil {
+			return err
+		}
+	}
+
+	token, key, err := store.Create(context.TODO(), args[0], scopes, ttl)
+	if err != nil {
+		return err
+	}
+
+	fmt.Println("* Key created :", key.ID)
+	fmt.Println(token)
+
+	return nil
+}
+
+// List Keys - Print one key per line with its state
+func listKeys(store *keys.Store) error {
+
+	list, err := store.List(context.TODO())
+	if err != nil {
+		return err
+	}
+
+	for _, key := range list {
+		state := "active"
+		switch {
+		case key.RevokedAt != nil:
+			state = "revoked " + key.RevokedAt.Format(time.RFC3339)
+		case key.ExpiresAt != nil && time.Now().After(*key.ExpiresAt):
+			state = "expired " + key.ExpiresAt.Format(time.RFC3339)
+		case key.ExpiresAt != nil:
+			state = "expires " + key.ExpiresAt.Format(time.RFC3339)
+		}
+		fmt.Printf("%s\t%s\t%s\t%s\n", key.ID, key.Name, strings.Join(key.Scopes, ","), state)
+	}
+
+	return nil
+}
+
+// Revoke Key - Refuse the key from now on
+func revokeKey(store *keys.Store, args []string) error {
+
+	if len(args) < 1 {
+		return errors.New(usage)
+	}
+
+	if err := store.Revoke(context.TODO(), args[0]); err != nil {
+		return err
+	}
+
+	fmt.Println("* Key revoked :", args[0])
+
+	return nil
+}
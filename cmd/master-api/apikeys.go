@@ -0,0 +1,94 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"time"
+
+	"catchall/internal/apierror"
+	"catchall/internal/keys"
+
+	"github.com/gorilla/mux"
+)
+
+// API keys required by the routes, nil with the open access
+var apiKeys *keys.Store
+
+type keyRequest struct {
+	Name   string `json:"name"`
+	Scopes string `json:"scopes"` // comma separated list, e.g. "events:write,domains:read"
+	TTL    string `json:"ttl"`    // duration such as 30d, the key never expires without it
+}
+
+type keyCreated struct {
+	*keys.Key
+	Token string `json:"token"`
+}
+
+// List Keys - Controller to get every API key, without their secret
+func listKeys(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	list, err := apiKeys.List(r.Context())
+	if err != nil {
+		apierror.Backend(w, r, err)
+		return
+	}
+
+	json.NewEncoder(w).Encode(list)
+}
+
+// Create Key - Controller to create an API key, its token is only returned once
+func createKey(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	request := &keyRequest{}
+	if err := json.NewDecoder(r.Body).Decode(request); err != nil {
+		apierror.Invalid(w, r, err)
+		return
+	}
+	if len(request.Name) == 0 {
+		apierror.Write(w, r, 400, "missing name")
+		return
+	}
+
+	scopes, err := keys.ParseScopes(request.Scopes)
+	if err != nil {
+		apierror.Invalid(w, r, err)
+		return
+	}
+	var ttl time.Duration
+	if len(request.TTL) > 0 {
+		if ttl, err = parseWindow(request.TTL); err != nil {
+			apierror.Invalid(w, r, err)
+			return
+		}
+	}
+
+	token, key, err := apiKeys.Create(r.Context(), request.Name, scopes, ttl)
+	if err != nil {
+		apierror.Backend(w, r, err)
+		return
+	}
+
+	w.WriteHeader(201)
+	json.NewEncoder(w).Encode(keyCreated{Key: key, Token: token})
+}
+
+// Revoke Key - Controller to revoke an API key
+func revokeKey(w http.ResponseWriter, r *http.Request) {
+
+	var params = mux.Vars(r)
+
+	err := apiKeys.Revoke(r.Context(), params["id"])
+	if err == keys.ErrNotFound {
+		apierror.Write(w, r, 404, err.Error())
+		return
+	}
+	if err != nil {
+		apierror.Backend(w, r, err)
+		return
+	}
+
+	w.WriteHeader(204)
+}
@@ -0,0 +1,127 @@
+package main
+
+import (
+	"errors"
+	"math"
+	"strconv"
+
+	"catchall/internal/policy"
+)
+
+// Precision and maximum number of iterations of the continued fraction of the incomplete beta function
+const (
+	betaEpsilon    = 1e-12
+	betaIterations = 100000
+)
+
+var errConfidence = errors.New("invalid minimum confidence, expected a number between 0 and 1")
+
+// Confidence - Posterior probability that the bounce rate of the domain is below the catch-all rate of the rule
+// The prior of the bounce rate is a neutral Beta(1, b), an unseen domain being as likely CatchAll as not,
+// and the bounce rate follows a Beta(1 + bounced, b + delivered) distribution once the events are observed
+func confidence(r policy.Rule, delivered int64, bounced int64) float64 {
+
+	if r.CatchAllRate >= 1 {
+		return 1
+	}
+	prior := math.Log(0.5) / math.Log1p(-r.CatchAllRate)
+
+	return incompleteBeta(1+float64(bounced), prior+float64(delivered), r.CatchAllRate)
+}
+
+// Classify Confidence - Status of the counters when a minimum confidence is required
+// The domain is CatchAll or NonCatchAll only when the probability of the status reaches the minimum
+func classifyConfidence(confidence float64, minConfidence float64) string {
+	switch {
+	case confidence >= minConfidence:
+		return CATCHALL_STATUS
+	case 1-confidence >= minConfidence:
+		return NONCATCHALL_STATUS
+	}
+	return UNKNOWN_STATUS
+}
+
+// Parse Confidence - Minimum confidence between 0 and 1, zero when empty
+func parseConfidence(value string) (float64, error) {
+
+	if len(value) == 0 {
+		return 0, nil
+	}
+	confidence, err := strconv.ParseFloat(value, 64)
+	if err != nil || confidence <= 0 || confidence > 1 {
+		return 0, errConfidence
+	}
+
+	return confidence, nil
+}
+
+// Incomplete Beta - Regularized incomplete beta function I_x(a, b), the CDF of Beta(a, b) at x
+func incompleteBeta(a float64, b float64, x float64) float64 {
+
+	if x <= 0 {
+		return 0
+	}
+	if x >= 1 {
+		return 1
+	}
+
+	la, _ := math.Lgamma(a)
+	lb, _ := math.Lgamma(b)
+	lab, _ := math.Lgamma(a + b)
+	front := math.Exp(lab - la - lb + a*math.Log(x) + b*math.Log1p(-x))
+
+	// The continued fraction converges quickly on this side of the mean, the symmetry is used on the other one
+	if x < (a+1)/(a+b+2) {
+		return front * betaFraction(a, b, x) / a
+	}
+	return 1 - front*betaFraction(b, a, 1-x)/b
+}
+
+// Beta Fraction - Continued fraction of the incomplete beta function, evaluated with the Lentz method
+func betaFraction(a float64, b float64, x float64) float64 {
+
+	const tiny = 1e-300
+
+	c, d := 1.0, 1-(a+b)*x/(a+1)
+	if math.Abs(d) < tiny {
+		d = tiny
+	}
+	d = 1 / d
+	h := d
+
+	for m := 1.0; m <= betaIterations; m++ {
+
+		// Even step
+		aa := m * (b - m) * x / ((a + 2*m - 1) * (a + 2*m))
+		d = 1 + aa*d
+		if math.Abs(d) < tiny {
+			d = tiny
+		}
+		c = 1 + aa/c
+		if math.Abs(c) < tiny {
+			c = tiny
+		}
+		d = 1 / d
+		h *= d * c
+
+		// Odd step
+		aa = -(a + m) * (a + b + m) * x / ((a + 2*m) * (a + 2*m + 1))
+		d = 1 + aa*d
+		if math.Abs(d) < tiny {
+			d = tiny
+		}
+		c = 1 + aa/c
+		if math.Abs(c) < tiny {
+			c = tiny
+		}
+		d = 1 / d
+		delta := d * c
+		h *= delta
+
+		if math.Abs(delta-1) < betaEpsilon {
+			break
+		}
+	}
+
+	return h
+}
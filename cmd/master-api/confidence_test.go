@@ -0,0 +1,63 @@
+package main
+
+import (
+	"math"
+	"testing"
+
+	"catchall/internal/policy"
+)
+
+func TestIncompleteBeta(t *testing.T) {
+	tests := []struct {
+		name     string
+		a, b, x  float64
+		expected float64
+	}{
+		// I_x(1, b) = 1 - (1 - x)^b
+		{"a=1", 1, 3, 0.2, 1 - math.Pow(0.8, 3)},
+		{"a=1 fractional b", 1, 68.97, 0.01, 1 - math.Pow(0.99, 68.97)},
+		// I_x(a, 1) = x^a, evaluated by the symmetry above the mean
+		{"b=1", 4, 1, 0.9, math.Pow(0.9, 4)},
+		// I_x(2, 3) = 6x²(1-x)² + 4x³(1-x) + x⁴
+		{"binomial", 2, 3, 0.4, 0.5248},
+		{"binomial symmetric", 3, 2, 0.6, 1 - 0.5248},
+		{"median of a symmetric beta", 50, 50, 0.5, 0.5},
+		{"large b", 1, 1000000, 0.000001, 1 - math.Pow(1-0.000001, 1000000)},
+		{"lower bound", 2, 3, 0, 0},
+		{"upper bound", 2, 3, 1, 1},
+	}
+
+	for _, test := range tests {
+		got := incompleteBeta(test.a, test.b, test.x)
+		if math.Abs(got-test.expected) > 1e-9 {
+			t.Errorf("%s: I_%v(%v, %v) = %v, expected %v", test.name, test.x, test.a, test.b, got, test.expected)
+		}
+	}
+}
+
+func TestIncompleteBetaSymmetry(t *testing.T) {
+	for _, x := range []float64{0.001, 0.1, 0.35, 0.5, 0.8, 0.999} {
+		left := incompleteBeta(2.5, 7, x)
+		right := 1 - incompleteBeta(7, 2.5, 1-x)
+		if math.Abs(left-right) > 1e-9 {
+			t.Errorf("I_%v(2.5, 7) = %v, 1 - I_%v(7, 2.5) = %v", x, left, 1-x, right)
+		}
+	}
+}
+
+func TestConfidence(t *testing.T) {
+	rule := policy.Rule{CatchAllRate: 0.01}
+
+	if c := confidence(rule, 0, 0); math.Abs(c-0.5) > 1e-9 {
+		t.Fatalf("confidence without event %v, expected 0.5", c)
+	}
+	if c := confidence(rule, 1000000, 1); c < 0.999 {
+		t.Fatalf("confidence of a single bounce among a million deliveries %v", c)
+	}
+	if c := confidence(rule, 100, 50); c > 0.001 {
+		t.Fatalf("confidence of a bouncing domain %v", c)
+	}
+	if c := confidence(policy.Rule{CatchAllRate: 1}, 0, 10); c != 1 {
+		t.Fatalf("confidence with a catch-all rate of 1 %v", c)
+	}
+}
@@ -0,0 +1,175 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/tidwall/uhatools"
+)
+
+// A worker is a cluster identified by its list of servers
+type worker struct {
+	name    string
+	cluster *uhatools.Cluster
+}
+
+// Time given to the clusters to report the statistics of a domain
+const freshTimeout = 2 * time.Second
+
+// Statistics of a domain held by the workers and not aggregated in the database yet
+type freshness struct {
+	Counters map[string]int64 `json:"counters"`
+	Clusters int              `json:"clusters"`
+	Failed   int              `json:"failed"`
+}
+
+// Connect DB Cluster - Connect the master to an in-memory fault tolerant worker database
+func connectDBCluster(servers []string) (*uhatools.Cluster, error) {
+
+	cl := uhatools.OpenCluster(uhatools.ClusterOptions{
+		InitialServers: servers,
+	})
+
+	if err := pingDBCluster(cl); err != nil {
+		fmt.Println("* Failed to connect to the DB cluster")
+		cl.Close()
+		return nil, err
+	}
+
+	fmt.Println("* Connected to the DB cluster")
+	return cl, nil
+}
+
+// Ping DB Cluster - To verify connectivity
+func pingDBCluster(cl *uhatools.Cluster) error {
+
+	conn := cl.Get()
+	defer conn.Close()
+
+	_, err := uhatools.String(conn.Do("PING"))
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// Get Freshness - Sum the statistics of the domain held by every cluster after its last committed epoch
+// The clusters are queried concurrently, the ones which can't be queried in time are counted as failed
+func getFreshness(ctx context.Context, name string) *freshness {
+
+	ctx, cancel := context.WithTimeout(ctx, freshTimeout)
+	defer cancel()
+
+	type result struct {
+		counters map[string]int64
+		err      error
+	}
+	results := make(chan result, len(workers))
+
+	for _, w := range workers {
+		go func(w *worker) {
+			counters, err := getWorkerCounters(ctx, w, name)
+			results <- result{counters, err}
+		}(w)
+	}
+
+	fresh := &freshness{Counters: make(map[string]int64)}
+
+	for range workers {
+		r := <-results
+		if r.err != nil {
+			fresh.Failed++
+			continue
+		}
+		for t, count := range r.counters {
+			fresh.Counters[t] += count
+		}
+		fresh.Clusters++
+	}
+
+	return fresh
+}
+
+// Get Worker Counters - Retrieve the statistics of the domain not committed yet from a cluster
+func getWorkerCounters(ctx context.Context, worker *worker, name string) (map[string]int64, error) {
+
+	info, err := uhatools.String(doCluster(ctx, worker.cluster, "DBINFO"))
+	if err != nil {
+		return nil, err
+	}
+	resp, err := uhatools.Strings(doCluster(ctx, worker.cluster, "GET", name))
+	if err != nil {
+		return nil, err
+	}
+
+	// The epochs up to the watermark, or the retrieved one without watermark, are in the database
+	watermark, found, err := store.Watermark(ctx, worker.name)
+	if err != nil {
+		return nil, err
+	}
+	committed := watermark.Epoch
+	if !found {
+		committed = -1
+		fields := strings.Split(info, " ")
+		if len(fields) > 1 && fields[0] != "<nil>" {
+			committed, _ = strconv.ParseInt(fields[1], 32, 64)
+		}
+	}
+
+	// The pages of the following epoch up to the cursor, sorted by name, are in the database too
+	if len(watermark.Cursor) > 0 && name <= watermark.Cursor {
+		committed++
+	}
+
+	counters := make(map[string]int64)
+
+	// Each entry is the epoch, or total, its number of counters and the type and count pairs
+	for n := 0; n+1 < len(resp); {
+
+		entry := resp[n]
+		count, _ := strconv.Atoi(resp[n+1])
+		n += 2
+
+		epoch, _ := strconv.ParseInt(entry, 32, 64)
+		included := entry != "total" && epoch > committed
+
+		for i := 0; i < count && n+1 < len(resp); i, n = i+1, n+2 {
+			if included {
+				value, _ := strconv.ParseInt(resp[n+1], 10, 64)
+				counters[resp[n]] += value
+			}
+		}
+	}
+
+	return counters, nil
+}
+
+// Do Cluster - Run a command on the cluster, giving up when the context is done
+// The command abandoned completes in the background
+func doCluster(ctx context.Context, cluster *uhatools.Cluster, command string, args ...interface{}) (interface{}, error) {
+
+	type result struct {
+		reply interface{}
+		err   error
+	}
+	done := make(chan result, 1)
+
+	go func() {
+		conn := cluster.Get()
+		defer conn.Close()
+
+		reply, err := conn.Do(command, args...)
+		done <- result{reply, err}
+	}()
+
+	select {
+	case r := <-done:
+		return r.reply, r.err
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
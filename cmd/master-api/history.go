@@ -0,0 +1,202 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"catchall/internal/apierror"
+	"catchall/internal/names"
+
+	"github.com/gorilla/mux"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// Period of the history returned when no range is given
+const defaultHistoryWindow = 7 * 24 * time.Hour
+
+var errWindow = errors.New("invalid window")
+var errTime = errors.New("invalid time")
+var errGranularity = errors.New("invalid granularity")
+var errNoHistory = errors.New("the history is only kept in MongoDB")
+
+// Granularities of the history, the aggregator service writes hourly buckets
+var granularities = map[string]time.Duration{
+	"hour": time.Hour,
+	"day":  24 * time.Hour,
+}
+
+// Bucket - Counters of a domain over an hour, or over a longer granularity once summed
+type bucket struct {
+	Start    time.Time        `json:"start"    bson:"start"`
+	Counters map[string]int64 `json:"counters" bson:"counters"`
+}
+
+type history struct {
+	Domain      string    `json:"domain"`
+	Granularity string    `json:"granularity"`
+	From        time.Time `json:"from"`
+	To          time.Time `json:"to"`
+	Buckets     []*bucket `json:"buckets"`
+}
+
+// Parse Window - Duration such as 7d, 2w or any Go duration like 36h, zero when empty
+func parseWindow(window string) (time.Duration, error) {
+
+	if len(window) == 0 {
+		return 0, nil
+	}
+
+	unit := time.Duration(0)
+	switch {
+	case strings.HasSuffix(window, "d"):
+		unit = 24 * time.Hour
+	case strings.HasSuffix(window, "w"):
+		unit = 7 * 24 * time.Hour
+	}
+
+	var duration time.Duration
+	if unit > 0 {
+		count, err := strconv.ParseInt(window[:len(window)-1], 10, 64)
+		if err != nil {
+			return 0, errWindow
+		}
+		duration = time.Duration(count) * unit
+	} else {
+		var err error
+		if duration, err = time.ParseDuration(window); err != nil {
+			return 0, errWindow
+		}
+	}
+	if duration <= 0 {
+		return 0, errWindow
+	}
+
+	return duration, nil
+}
+
+// Parse Time - Time given as RFC 3339, as a date or as unix seconds, the default one when empty
+func parseTime(value string, byDefault time.Time) (time.Time, error) {
+
+	if len(value) == 0 {
+		return byDefault, nil
+	}
+	if t, err := time.Parse(time.RFC3339, value); err == nil {
+		return t.UTC(), nil
+	}
+	if t, err := time.Parse("2006-01-02", value); err == nil {
+		return t, nil
+	}
+	if seconds, err := strconv.ParseInt(value, 10, 64); err == nil {
+		return time.Unix(seconds, 0).UTC(), nil
+	}
+
+	return time.Time{}, errTime
+}
+
+// Get History - Controller to get the time series of the domain statistics
+// ?from=&to= bound the series, the last 7 days by default, and ?granularity= is hour or day
+func getHistory(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	var params = mux.Vars(r)
+	query := r.URL.Query()
+
+	h := &history{Granularity: query.Get("granularity"), Buckets: []*bucket{}}
+	if len(h.Granularity) == 0 {
+		h.Granularity = "hour"
+	}
+
+	name, err := names.Canonical(params["name"])
+	h.Domain = name
+	to := time.Now().UTC()
+	if err == nil {
+		to, err = parseTime(query.Get("to"), to)
+	}
+	if err == nil {
+		h.To = to
+		h.From, err = parseTime(query.Get("from"), to.Add(-defaultHistoryWindow))
+	}
+	size, found := granularities[h.Granularity]
+	if err == nil && !found {
+		err = errGranularity
+	}
+	if err == nil && h.From.After(h.To) {
+		err = errTime
+	}
+	if err != nil {
+		apierror.Invalid(w, r, err)
+		return
+	}
+
+	buckets, err := getBuckets(r.Context(), h.Domain, h.From, h.To)
+	if err != nil {
+		apierror.Backend(w, r, err)
+		return
+	}
+
+	// The hourly buckets are summed per granularity, they are sorted by start
+	for _, b := range buckets {
+		start := b.Start.Truncate(size)
+		if n := len(h.Buckets); n == 0 || !h.Buckets[n-1].Start.Equal(start) {
+			h.Buckets = append(h.Buckets, &bucket{Start: start, Counters: make(map[string]int64)})
+		}
+		last := h.Buckets[len(h.Buckets)-1]
+		for t, count := range b.Counters {
+			last.Counters[t] += count
+		}
+	}
+
+	json.NewEncoder(w).Encode(h)
+}
+
+// Get Buckets - Retrieve the hourly buckets of the domain starting between from and to, sorted by start
+func getBuckets(ctx context.Context, name string, from time.Time, to time.Time) ([]*bucket, error) {
+
+	query := bson.M{"name": name, "start": bson.M{"$gte": from, "$lte": to}}
+	findOptions := options.Find().SetSort(bson.D{{Key: "start", Value: 1}})
+
+	cursor, err := database.Collection("history").Find(ctx, query, findOptions)
+	if err != nil {
+		return nil, err
+	}
+	defer cursor.Close(ctx)
+
+	var buckets []*bucket
+	for cursor.Next(ctx) {
+		b := &bucket{}
+		if err := cursor.Decode(b); err != nil {
+			return nil, err
+		}
+		buckets = append(buckets, b)
+	}
+
+	return buckets, cursor.Err()
+}
+
+// Restrict - Replace the counters of the domain by the ones of the recent history only
+func (domain *domain) restrict(ctx context.Context, window time.Duration) error {
+
+	now := time.Now().UTC()
+	buckets, err := getBuckets(ctx, domain.Name, now.Add(-window).Truncate(time.Hour), now)
+	if err != nil {
+		return err
+	}
+
+	domain.Counters = make(map[string]int64)
+	for _, b := range buckets {
+		for t, count := range b.Counters {
+			domain.Counters[t] += count
+		}
+	}
+
+	domain.classify()
+
+	return nil
+}
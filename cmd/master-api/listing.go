@@ -0,0 +1,355 @@
+package main
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"catchall/internal/apierror"
+	"catchall/internal/names"
+	"catchall/internal/storage"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// Number of domains listed by default and at most in a page
+const (
+	defaultListLimit = 100
+	maxListLimit     = 1000
+)
+
+// Maximum number of domains read for a page, the statuses being filtered once classified
+// A page can therefore be incomplete while the next cursor is given
+const listScanLimit = 10000
+
+// Number of domains given their reversed name at once by the backfill
+const backfillBatchSize = 1000
+
+var errStatus = errors.New("invalid status")
+var errSort = errors.New("invalid sort, expected name, delivered or bounced")
+var errLimit = errors.New("invalid limit")
+var errVolume = errors.New("invalid minimum volume")
+var errCursor = errors.New("invalid cursor")
+
+// Listing - Page of domains and the cursor of the next page, empty after the last one
+type listing struct {
+	Domains []*listedDomain `json:"domains"`
+	Next    string          `json:"next"`
+}
+
+type listedDomain struct {
+	Name       string           `json:"name"`
+	Status     string           `json:"status"`
+	Confidence float64          `json:"confidence"`
+	Counters   map[string]int64 `json:"counters"`
+	LastSeen   *time.Time       `json:"lastSeen,omitempty"`
+}
+
+// Position of the last domain of a page in the sort order
+type listCursor struct {
+	Name  string `json:"n,omitempty"`
+	Value *int64 `json:"v,omitempty"`
+	ID    string `json:"id"`
+}
+
+// Create Domain Indexes - Indexes of the lookups, the suffix searches and the sorts of the listing
+func createDomainIndexes(database *mongo.Database) error {
+
+	models := []mongo.IndexModel{
+		{Keys: bson.D{{Key: "name", Value: 1}, {Key: "_id", Value: 1}}},
+		{Keys: bson.D{{Key: "reversed", Value: 1}}},
+		{Keys: bson.D{{Key: "delivered", Value: -1}, {Key: "_id", Value: -1}}},
+		{Keys: bson.D{{Key: "bounced", Value: -1}, {Key: "_id", Value: -1}}},
+		{Keys: bson.D{{Key: "lastSeen", Value: -1}}},
+	}
+
+	_, err := database.Collection("domains").Indexes().CreateMany(context.TODO(), models)
+
+	return err
+}
+
+// List Domains - Controller to list the domains page by page
+// Filters : ?status=CatchAll&prefix=mail.&suffix=*.edu&minVolume=100&seenAfter=2021-01-01
+// The domains not aggregated since the last time seen is recorded have none and are left out by ?seenAfter=
+// Sort by name, by default, or by the most delivered or bounced with ?sort=, the pages are given by ?cursor=&limit=
+// The statuses are given by the confidence with ?minConfidence=
+func listDomains(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	query := r.URL.Query()
+
+	filter, err := listFilter(query.Get("prefix"), query.Get("suffix"), query.Get("minVolume"), query.Get("seenAfter"))
+	if err != nil {
+		apierror.Invalid(w, r, err)
+		return
+	}
+	status, err := parseStatus(query.Get("status"))
+	if err != nil {
+		apierror.Invalid(w, r, err)
+		return
+	}
+	limit, err := parseLimit(query.Get("limit"))
+	if err != nil {
+		apierror.Invalid(w, r, err)
+		return
+	}
+	minConfidence, err := parseConfidence(query.Get("minConfidence"))
+	if err != nil {
+		apierror.Invalid(w, r, err)
+		return
+	}
+
+	field := query.Get("sort")
+	if len(field) == 0 {
+		field = "name"
+	}
+	if field != "name" && field != "delivered" && field != "bounced" {
+		apierror.Invalid(w, r, errSort)
+		return
+	}
+
+	if cursor := query.Get("cursor"); len(cursor) > 0 {
+		after, err := afterCursor(field, cursor)
+		if err != nil {
+			apierror.Invalid(w, r, err)
+			return
+		}
+		filter = append(filter, after)
+	}
+
+	page, err := listPage(r.Context(), filter, field, status, minConfidence, limit)
+	if err != nil {
+		apierror.Backend(w, r, err)
+		return
+	}
+
+	json.NewEncoder(w).Encode(page)
+}
+
+// List Filter - Conditions on the names, the volume and the last time the domains were seen
+func listFilter(prefix string, suffix string, minVolume string, seenAfter string) (bson.A, error) {
+
+	filter := bson.A{}
+
+	// The anchored regular expressions are searched as ranges of the indexes
+	if len(prefix) > 0 {
+		canonical, err := names.Fragment(prefix)
+		if err != nil {
+			return nil, err
+		}
+		filter = append(filter, bson.M{"name": primitive.Regex{Pattern: "^" + regexp.QuoteMeta(canonical)}})
+	}
+
+	// The suffix is searched as a prefix of the reversed names, *.edu is the suffix .edu
+	if suffix = strings.TrimPrefix(strings.TrimSpace(suffix), "*"); len(suffix) > 0 {
+		canonical, err := names.Fragment(suffix)
+		if err != nil {
+			return nil, err
+		}
+		reversed := storage.Reverse(canonical)
+		filter = append(filter, bson.M{"reversed": primitive.Regex{Pattern: "^" + regexp.QuoteMeta(reversed)}})
+	}
+
+	if len(minVolume) > 0 {
+		volume, err := strconv.ParseInt(minVolume, 10, 64)
+		if err != nil || volume < 0 {
+			return nil, errVolume
+		}
+		total := bson.A{bson.M{"$ifNull": bson.A{"$delivered", 0}}, bson.M{"$ifNull": bson.A{"$bounced", 0}}}
+		filter = append(filter, bson.M{"$expr": bson.M{"$gte": bson.A{bson.M{"$add": total}, volume}}})
+	}
+
+	if len(seenAfter) > 0 {
+		after, err := parseTime(seenAfter, time.Time{})
+		if err != nil {
+			return nil, err
+		}
+		filter = append(filter, bson.M{"lastSeen": bson.M{"$gte": after}})
+	}
+
+	return filter, nil
+}
+
+func parseStatus(status string) (string, error) {
+	for _, s := range []string{"", UNKNOWN_STATUS, CATCHALL_STATUS, NONCATCHALL_STATUS} {
+		if strings.EqualFold(status, s) {
+			return s, nil
+		}
+	}
+	return "", errStatus
+}
+
+func parseLimit(limit string) (int, error) {
+	if len(limit) == 0 {
+		return defaultListLimit, nil
+	}
+	value, err := strconv.Atoi(limit)
+	if err != nil || value <= 0 || value > maxListLimit {
+		return 0, errLimit
+	}
+	return value, nil
+}
+
+// After Cursor - Condition on the domains following the cursor in the sort order
+// The domains are sorted by name then id, or by decreasing counter then id with the domains without counter last
+func afterCursor(field string, cursor string) (bson.M, error) {
+
+	data, err := base64.RawURLEncoding.DecodeString(cursor)
+	if err != nil {
+		return nil, errCursor
+	}
+	c := &listCursor{}
+	if err := json.Unmarshal(data, c); err != nil {
+		return nil, errCursor
+	}
+	id, err := primitive.ObjectIDFromHex(c.ID)
+	if err != nil {
+		return nil, errCursor
+	}
+
+	if field == "name" {
+		return bson.M{"$or": bson.A{
+			bson.M{"name": bson.M{"$gt": c.Name}},
+			bson.M{"name": c.Name, "_id": bson.M{"$gt": id}},
+		}}, nil
+	}
+
+	if c.Value == nil {
+		return bson.M{field: nil, "_id": bson.M{"$lt": id}}, nil
+	}
+
+	return bson.M{"$or": bson.A{
+		bson.M{field: bson.M{"$lt": *c.Value}},
+		bson.M{field: *c.Value, "_id": bson.M{"$lt": id}},
+		bson.M{field: nil},
+	}}, nil
+}
+
+// List Page - Read the domains in the sort order until the page is full, keeping the ones of the status if any
+func listPage(ctx context.Context, filter bson.A, field string, status string, minConfidence float64, limit int) (*listing, error) {
+
+	query := bson.M{}
+	if len(filter) > 0 {
+		query["$and"] = filter
+	}
+
+	sort := bson.D{{Key: field, Value: -1}, {Key: "_id", Value: -1}}
+	if field == "name" {
+		sort = bson.D{{Key: "name", Value: 1}, {Key: "_id", Value: 1}}
+	}
+	findOptions := options.Find().SetSort(sort).SetLimit(listScanLimit)
+
+	cursor, err := database.Collection("domains").Find(ctx, query, findOptions)
+	if err != nil {
+		return nil, err
+	}
+	defer cursor.Close(ctx)
+
+	page := &listing{Domains: []*listedDomain{}}
+	var last *domain
+	scanned := 0
+
+	for len(page.Domains) < limit && cursor.Next(ctx) {
+		d := &domain{minConfidence: minConfidence}
+		if err := cursor.Decode(d); err != nil {
+			return nil, err
+		}
+		d.classify()
+		last = d
+		scanned++
+
+		if len(status) > 0 && d.Status != status {
+			continue
+		}
+		page.Domains = append(page.Domains, &listedDomain{d.Name, d.Status, d.Confidence, d.Counters, d.LastSeen})
+	}
+	if err := cursor.Err(); err != nil {
+		return nil, err
+	}
+
+	// The listing goes on after the last domain read when the page is full or the scan limit is reached
+	if last != nil && (len(page.Domains) == limit || scanned == listScanLimit) {
+		c := &listCursor{Name: last.Name, ID: last.ID.Hex()}
+		if value, found := last.Counters[field]; found {
+			c.Value = &value
+		}
+		data, _ := json.Marshal(c)
+		page.Next = base64.RawURLEncoding.EncodeToString(data)
+	}
+
+	return page, nil
+}
+
+// Backfill Reversed - Give their reversed name to the domains stored before the suffix searches, batch by batch
+// The time the domains were last seen can't be backfilled, it is only set once they are aggregated again
+func backfillReversed(database *mongo.Database) {
+
+	collection := database.Collection("domains")
+	query := bson.M{"reversed": bson.M{"$exists": false}}
+	findOptions := options.Find().SetProjection(bson.M{"name": 1}).SetBatchSize(backfillBatchSize)
+
+	cursor, err := collection.Find(context.TODO(), query, findOptions)
+	if err != nil {
+		fmt.Println("* Failed to backfill the reversed names :", err)
+		return
+	}
+	defer cursor.Close(context.TODO())
+
+	var operations []mongo.WriteModel
+	count := 0
+
+	flush := func() error {
+		if len(operations) == 0 {
+			return nil
+		}
+		_, err := collection.BulkWrite(context.TODO(), operations, options.BulkWrite().SetOrdered(false))
+		count += len(operations)
+		operations = operations[:0]
+		return err
+	}
+
+	for cursor.Next(context.TODO()) {
+		var d struct {
+			ID   primitive.ObjectID `bson:"_id"`
+			Name string             `bson:"name"`
+		}
+		if err := cursor.Decode(&d); err != nil {
+			fmt.Println("* Failed to backfill the reversed names :", err)
+			return
+		}
+
+		operation := mongo.NewUpdateOneModel()
+		operation.SetFilter(bson.M{"_id": d.ID})
+		operation.SetUpdate(bson.M{"$set": bson.M{"reversed": storage.Reverse(d.Name)}})
+		operations = append(operations, operation)
+
+		if len(operations) == backfillBatchSize {
+			if err := flush(); err != nil {
+				fmt.Println("* Failed to backfill the reversed names :", err)
+				return
+			}
+		}
+	}
+	err = cursor.Err()
+	if err == nil {
+		err = flush()
+	}
+	if err != nil {
+		fmt.Println("* Failed to backfill the reversed names :", err)
+		return
+	}
+
+	if count > 0 {
+		fmt.Println("* Reversed names backfilled :", count)
+	}
+}
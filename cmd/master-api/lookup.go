@@ -0,0 +1,184 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"strings"
+
+	"catchall/internal/apierror"
+	"catchall/internal/names"
+)
+
+// Maximum number of domains queried at once
+const lookupBatchSize = 1000
+
+type lookupStatus struct {
+	Name       string   `json:"name"`
+	Status     string   `json:"status,omitempty"`
+	Confidence *float64 `json:"confidence,omitempty"`
+	Found      bool     `json:"found"`
+	Error      string   `json:"error,omitempty"`
+}
+
+// Lookup Domains - Controller to get the status of many domains sent as a JSON array or one per line
+// The statuses are streamed back in the request order as NDJSON, including the domains not found
+// The statuses are given by the confidence with ?minConfidence=
+func lookupDomains(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/x-ndjson")
+
+	minConfidence, err := parseConfidence(r.URL.Query().Get("minConfidence"))
+	if err != nil {
+		apierror.Invalid(w, r, err)
+		return
+	}
+
+	encoder := json.NewEncoder(w)
+	flusher, _ := w.(http.Flusher)
+	batch := make([]string, 0, lookupBatchSize)
+	written := false
+	invalid := true
+
+	flush := func() error {
+		statuses, err := lookupBatch(r.Context(), batch, minConfidence)
+		if err != nil {
+			invalid = false
+			return err
+		}
+		for _, status := range statuses {
+			encoder.Encode(status)
+		}
+		if flusher != nil {
+			flusher.Flush()
+		}
+		batch = batch[:0]
+		written = true
+		return nil
+	}
+
+	err = readNames(r.Body, func(name string) error {
+		batch = append(batch, name)
+		if len(batch) < lookupBatchSize {
+			return nil
+		}
+		return flush()
+	})
+	if err == nil && len(batch) > 0 {
+		err = flush()
+	}
+
+	// Once the statuses are streamed the error can only be reported on the last line
+	switch {
+	case err == nil:
+	case written:
+		encoder.Encode(lookupStatus{Error: err.Error()})
+	case invalid:
+		apierror.Invalid(w, r, err)
+	default:
+		apierror.Backend(w, r, err)
+	}
+}
+
+// Read Names - Decode the domain names one by one from a JSON array or from lines
+func readNames(body io.Reader, handle func(name string) error) error {
+
+	rd := bufio.NewReader(body)
+
+	for {
+		c, err := rd.ReadByte()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if c == ' ' || c == '\t' || c == '\r' || c == '\n' {
+			continue
+		}
+		rd.UnreadByte()
+		if c == '[' {
+			return readNamesArray(rd, handle)
+		}
+		return readNamesLines(rd, handle)
+	}
+}
+
+func readNamesArray(rd io.Reader, handle func(name string) error) error {
+
+	decoder := json.NewDecoder(rd)
+	if _, err := decoder.Token(); err != nil {
+		return err
+	}
+
+	for decoder.More() {
+		var name string
+		if err := decoder.Decode(&name); err != nil {
+			return err
+		}
+		if err := handle(name); err != nil {
+			return err
+		}
+	}
+
+	_, err := decoder.Token()
+
+	return err
+}
+
+func readNamesLines(rd io.Reader, handle func(name string) error) error {
+
+	scanner := bufio.NewScanner(rd)
+
+	for scanner.Scan() {
+		name := strings.TrimSpace(scanner.Text())
+		if len(name) == 0 {
+			continue
+		}
+		if err := handle(name); err != nil {
+			return err
+		}
+	}
+
+	return scanner.Err()
+}
+
+// Lookup Batch - Retrieve the domains at once and classify them in the given order
+// The names are reported as given, the invalid ones with an error
+func lookupBatch(ctx context.Context, batch []string, minConfidence float64) ([]lookupStatus, error) {
+
+	canonical := make([]string, len(batch))
+	for i, name := range batch {
+		canonical[i], _ = names.Canonical(name)
+	}
+
+	stored, err := store.GetMany(ctx, canonical)
+	if err != nil {
+		return nil, err
+	}
+
+	found := make(map[string]*domain, len(stored))
+	for name, s := range stored {
+		d := &domain{minConfidence: minConfidence}
+		d.load(s)
+		d.classify()
+		found[name] = d
+	}
+
+	statuses := make([]lookupStatus, len(batch))
+	for i, name := range batch {
+		if len(canonical[i]) == 0 {
+			statuses[i] = lookupStatus{Name: name, Error: names.ErrInvalid.Error()}
+			continue
+		}
+		d, existed := found[canonical[i]]
+		if !existed {
+			d = &domain{Name: canonical[i], minConfidence: minConfidence}
+			d.classify()
+		}
+		statuses[i] = lookupStatus{Name: name, Status: d.Status, Confidence: &d.Confidence, Found: existed}
+	}
+
+	return statuses, nil
+}
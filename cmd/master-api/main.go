@@ -3,112 +3,275 @@ package main
 import (
 	"context"
 	"encoding/json"
+	"flag"
 	"fmt"
 	"log"
 	"net/http"
 	"os"
+	"strings"
+	"time"
+
+	"catchall/internal/apierror"
+	"catchall/internal/keys"
+	"catchall/internal/names"
+	"catchall/internal/policy"
+	"catchall/internal/storage"
 
 	"github.com/gorilla/mux"
 
-	"go.mongodb.org/mongo-driver/bson"
 	"go.mongodb.org/mongo-driver/bson/primitive"
 	"go.mongodb.org/mongo-driver/mongo"
-	"go.mongodb.org/mongo-driver/mongo/options"
 )
 
+var store storage.Store
+
+// Database of the listing, the history and the webhooks, nil when the store is not MongoDB
 var database *mongo.Database
 
+// Worker clusters queried for the statistics not aggregated yet
+var workers []*worker
+
+// The counters of every event type are stored alongside the name
 type domain struct {
-	ID        primitive.ObjectID `json:"-"      bson:"_id,omitempty"`
-	Name      string             `json:"-"      bson:"name"`
-	Delivered int                `json:"-"      bson:"delivered"`
-	Bounced   int                `json:"-"      bson:"bounced"`
-	Status    string             `json:"status" bson:"-"`
+	ID         primitive.ObjectID `json:"-"                  bson:"_id,omitempty"`
+	Name       string             `json:"-"                  bson:"name"`
+	Reversed   string             `json:"-"                  bson:"reversed,omitempty"`
+	LastSeen   *time.Time         `json:"lastSeen,omitempty" bson:"lastSeen,omitempty"`
+	Counters   map[string]int64   `json:"-"                  bson:",inline"`
+	Status     string             `json:"status"             bson:"-"`
+	Confidence float64            `json:"confidence"         bson:"-"`
+	Window     string             `json:"window,omitempty"   bson:"-"`
+	Fresh      *freshness         `json:"fresh,omitempty"    bson:"-"`
+
+	minConfidence float64 // status given by the confidence when set
 }
 
 const (
-	UNKNOWN_STATUS     = "Unknown"
-	CATCHALL_STATUS    = "CatchAll"
-	NONCATCHALL_STATUS = "NonCatchAll"
+	UNKNOWN_STATUS     = policy.Unknown
+	CATCHALL_STATUS    = policy.CatchAll
+	NONCATCHALL_STATUS = policy.NonCatchAll
 )
 
 func main() {
 
 	var err error
-	if len(os.Args) < 3 {
-		fmt.Fprintf(os.Stderr, "Specify the address of database cluster servers")
+	policyPath := flag.String("policy", "", "path of the JSON classification policy, reloaded when it changes")
+	keysAddress := flag.String("keys", "", "address of the master database holding the API keys required by the routes")
+	open := flag.Bool("open", false, "serve the routes to anyone without API key")
+	flag.Parse()
+
+	args := flag.Args()
+	if len(args) < 2 {
+		fmt.Fprintf(os.Stderr, "Specify the address of the master database, or bolt:<path> for an embedded file, and the port")
+		os.Exit(1)
+	}
+	if (len(*keysAddress) > 0) == *open {
+		fmt.Fprintf(os.Stderr, "Specify either the address of the API keys database with -keys or the open access with -open")
 		os.Exit(1)
 	}
 
 	fmt.Println("\n# Starting 'CatchAll - Master Web Server' application")
-	fmt.Println("* Application try connection to the master database", os.Args[1])
 
-	database, err = connectDB(os.Args[1])
+	if len(*policyPath) > 0 {
+		fmt.Println("* Application loads the classification policy", *policyPath)
+		if err = policy.Watch(*policyPath); err != nil {
+			fmt.Fprintln(os.Stderr, "Invalid classification policy :", err)
+			os.Exit(1)
+		}
+	}
+
+	fmt.Println("* Application try connection to the master database", args[0])
+
+	store, err = storage.OpenReadOnly(args[0])
 	if err != nil {
+		fmt.Println("* Failed to open the master database :", err)
 		return
 	}
+	defer store.Close()
+	fmt.Println("* Connected to the master DB")
 
-	fmt.Println("* Application starts the web server on port", os.Args[2])
-	startWebServer(os.Args[2])
-}
-
-// Connect DB - Connect the master to an in-memory fault tolerant worker database
-func connectDB(address string) (*mongo.Database, error) {
+	database = storage.Database(store)
+	if database == nil {
+		fmt.Println("* Application serves the domains only, the listing, the history and the webhooks need MongoDB")
+	} else {
+		fmt.Println("* Application creates the indexes of the domains")
+		if err = createDomainIndexes(database); err != nil {
+			fmt.Println("* Failed to create the indexes :", err)
+			return
+		}
+		go backfillReversed(database)
+	}
 
-	clientOptions := options.Client().ApplyURI("mongodb://" + address)
-	client, err := mongo.Connect(context.TODO(), clientOptions)
+	if *open {
+		fmt.Println("* WARNING : Application serves the routes to anyone, no API key is required")
+	} else {
+		fmt.Println("* Application try connection to the API keys database", *keysAddress)
 
-	if err != nil {
-		return nil, err
+		keysStore, err := storage.OpenMongo(*keysAddress)
+		if err != nil {
+			fmt.Println("* Failed to open the API keys database :", err)
+			return
+		}
+		defer keysStore.Close()
+		apiKeys = keys.NewStore(storage.Database(keysStore).Collection("keys"))
 	}
 
-	fmt.Println("* Connected to the master DB")
+	// The optional clusters are named by their list of servers, as in the aggregator service
+	for _, name := range args[2:] {
+
+		servers := strings.Split(name, ",")
+
+		fmt.Println("* Application try connection to the database cluster", servers)
 
-	db := client.Database("catchall")
+		cluster, err := connectDBCluster(servers)
+		if err != nil {
+			return
+		}
+		defer cluster.Close()
 
-	return db, nil
+		workers = append(workers, &worker{name: name, cluster: cluster})
+	}
+
+	fmt.Println("* Application starts the web server on port", args[1])
+	startWebServer(args[1])
 }
 
 // Start Web Server - Expose the master database to http calls
 func startWebServer(port string) {
 
 	router := mux.NewRouter().StrictSlash(true)
+	router.Use(apierror.RequestID)
+	router.NotFoundHandler = apierror.RequestID(http.HandlerFunc(apierror.NotFound))
+	router.MethodNotAllowedHandler = apierror.RequestID(http.HandlerFunc(apierror.MethodNotAllowed))
+
+	read := apiKeys.Require(keys.DomainsRead)
+	admin := apiKeys.Require(keys.Admin)
+
+	router.Handle("/domains/lookup", read(http.HandlerFunc(lookupDomains))).Methods("POST")
+	router.Handle("/domains/{name}", read(http.HandlerFunc(getDomain))).Methods("GET")
+	router.Handle("/policy", read(http.HandlerFunc(getPolicy))).Methods("GET")
 
-	router.HandleFunc("/domains/{name}", getDomain).Methods("GET")
+	// The other routes read the collections only kept in MongoDB
+	if database != nil {
+		router.Handle("/domains", read(http.HandlerFunc(listDomains))).Methods("GET")
+		router.Handle("/domains/{name}/history", read(http.HandlerFunc(getHistory))).Methods("GET")
+
+		router.Handle("/subscriptions", admin(http.HandlerFunc(listSubscriptions))).Methods("GET")
+		router.Handle("/subscriptions", admin(http.HandlerFunc(createSubscription))).Methods("POST")
+		router.Handle("/subscriptions/{id}", admin(http.HandlerFunc(deleteSubscription))).Methods("DELETE")
+		router.Handle("/subscriptions/{id}/deliveries", admin(http.HandlerFunc(listDeliveries))).Methods("GET")
+		router.Handle("/deliveries/{id}/replay", admin(http.HandlerFunc(replayDelivery))).Methods("POST")
+
+		// The keys are managed with the admin scope unless the access is open
+		if apiKeys != nil {
+			router.Handle("/keys", admin(http.HandlerFunc(listKeys))).Methods("GET")
+			router.Handle("/keys", admin(http.HandlerFunc(createKey))).Methods("POST")
+			router.Handle("/keys/{id}", admin(http.HandlerFunc(revokeKey))).Methods("DELETE")
+		}
+	}
 
 	log.Fatal(http.ListenAndServe(":"+port, router))
 }
 
 // Get Domain - Controller to get the domain
-// TODO - Add validation, authorization of the request and manage potential issues
+// The statistics not aggregated yet by the workers are included with ?fresh=true
+// The domain is classified on its recent history only with ?window=7d
+// The domain is classified by its confidence with ?minConfidence=0.95
 func getDomain(w http.ResponseWriter, r *http.Request) {
 	w.Header().Set("Content-Type", "application/json")
 
 	var params = mux.Vars(r)
-	d := &domain{}
+	d := &domain{Window: r.URL.Query().Get("window")}
 
-	err := d.get(params["name"])
+	name, err := names.Canonical(params["name"])
 	if err != nil {
-		w.WriteHeader(404)
+		apierror.Invalid(w, r, err)
+		return
+	}
+	window, err := parseWindow(d.Window)
+	if err != nil {
+		apierror.Invalid(w, r, err)
+		return
+	}
+	if window > 0 && database == nil {
+		apierror.Invalid(w, r, errNoHistory)
+		return
+	}
+	d.minConfidence, err = parseConfidence(r.URL.Query().Get("minConfidence"))
+	if err != nil {
+		apierror.Invalid(w, r, err)
+		return
+	}
+
+	err = d.get(r.Context(), name)
+	if err == nil && window > 0 {
+		err = d.restrict(r.Context(), window)
+	}
+	if r.URL.Query().Get("fresh") == "true" && (err == nil || err == storage.ErrNotFound) {
+		d.Fresh = getFreshness(r.Context(), name)
+		if err == storage.ErrNotFound && len(d.Fresh.Counters) > 0 {
+			err = nil
+		}
+		d.merge(d.Fresh.Counters)
+	}
+	if err == storage.ErrNotFound {
+		apierror.Write(w, r, 404, "domain not found")
+		return
+	}
+	if err != nil {
+		apierror.Backend(w, r, err)
+		return
 	}
 
 	json.NewEncoder(w).Encode(d)
 }
 
 // Get - Retrieve domain from the database
-func (domain *domain) get(name string) error {
-	var ctx context.Context
-
-	query := bson.M{"name": name}
-	err := database.Collection("domains").FindOne(ctx, query).Decode(&domain)
+func (domain *domain) get(ctx context.Context, name string) error {
 
-	if domain.Bounced > 0 {
-		domain.Status = NONCATCHALL_STATUS
-	} else if domain.Delivered < 1000 {
-		domain.Status = UNKNOWN_STATUS
-	} else {
-		domain.Status = CATCHALL_STATUS
+	stored, err := store.Get(ctx, name)
+	if err == nil {
+		domain.load(stored)
 	}
+	domain.Name = name
+
+	domain.classify()
 
 	return err
 }
+
+// Load - Take the counters and the last time seen of the stored domain
+func (domain *domain) load(stored *storage.Domain) {
+	domain.Name = stored.Name
+	domain.Counters = stored.Counters
+	if !stored.LastSeen.IsZero() {
+		lastSeen := stored.LastSeen
+		domain.LastSeen = &lastSeen
+	}
+}
+
+// Merge - Add counters to the domain and classify it again
+func (domain *domain) merge(counters map[string]int64) {
+
+	if domain.Counters == nil {
+		domain.Counters = make(map[string]int64)
+	}
+	for t, count := range counters {
+		domain.Counters[t] += count
+	}
+
+	domain.classify()
+}
+
+// Classify - Compute the status and the confidence of the domain from its counters and the active policy
+func (domain *domain) classify() {
+	rule := policy.Active().RuleFor(domain.Name)
+	delivered, bounced := domain.Counters["delivered"], domain.Counters["bounced"]
+
+	domain.Confidence = confidence(rule, delivered, bounced)
+	if domain.minConfidence > 0 {
+		domain.Status = classifyConfidence(domain.Confidence, domain.minConfidence)
+		return
+	}
+	domain.Status = rule.Classify(delivered, bounced)
+}
@@ -0,0 +1,15 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+
+	"catchall/internal/policy"
+)
+
+// Get Policy - Controller to get the active classification policy
+func getPolicy(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	json.NewEncoder(w).Encode(policy.Active())
+}
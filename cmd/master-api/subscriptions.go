@@ -0,0 +1,217 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/url"
+	"time"
+
+	"catchall/internal/apierror"
+
+	"github.com/gorilla/mux"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// Number of deliveries returned by the delivery log
+const deliveryLogLimit = 100
+
+var errURL = errors.New("invalid url, expected an absolute http or https url")
+var errID = errors.New("invalid id")
+
+// Subscription - Endpoint notified by the aggregator service of the status changes
+// The secret signing the callbacks is only returned at the creation
+type subscription struct {
+	ID        primitive.ObjectID `json:"id"               bson:"_id,omitempty"`
+	URL       string             `json:"url"              bson:"url"`
+	Secret    string             `json:"secret,omitempty" bson:"secret"`
+	CreatedAt time.Time          `json:"createdAt"        bson:"createdAt"`
+}
+
+// Delivery - Status change sent to a subscription and the log of its attempts
+type delivery struct {
+	ID           primitive.ObjectID `json:"id"           bson:"_id"`
+	Subscription primitive.ObjectID `json:"subscription" bson:"subscription"`
+	Event        struct {
+		Domain string    `json:"domain" bson:"domain"`
+		From   string    `json:"from"   bson:"from"`
+		To     string    `json:"to"     bson:"to"`
+		Epoch  string    `json:"epoch"  bson:"epoch"`
+		At     time.Time `json:"at"     bson:"at"`
+	} `json:"event" bson:"event"`
+	Status      string    `json:"status"      bson:"status"`
+	Attempts    int       `json:"attempts"    bson:"attempts"`
+	NextAttempt time.Time `json:"nextAttempt" bson:"nextAttempt"`
+	CreatedAt   time.Time `json:"createdAt"   bson:"createdAt"`
+	Log         []struct {
+		At         time.Time `json:"at"                   bson:"at"`
+		StatusCode int       `json:"statusCode,omitempty" bson:"statusCode,omitempty"`
+		Error      string    `json:"error,omitempty"      bson:"error,omitempty"`
+	} `json:"log" bson:"log"`
+}
+
+// Create Subscription - Controller to register an endpoint, the secret is generated when not given
+func createSubscription(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	s := &subscription{}
+	if err := json.NewDecoder(r.Body).Decode(s); err != nil {
+		apierror.Invalid(w, r, err)
+		return
+	}
+	if u, err := url.Parse(s.URL); err != nil || (u.Scheme != "http" && u.Scheme != "https") || len(u.Host) == 0 {
+		apierror.Invalid(w, r, errURL)
+		return
+	}
+	if len(s.Secret) == 0 {
+		b := make([]byte, 32)
+		if _, err := rand.Read(b); err != nil {
+			apierror.Backend(w, r, err)
+			return
+		}
+		s.Secret = hex.EncodeToString(b)
+	}
+	s.ID = primitive.NilObjectID
+	s.CreatedAt = time.Now().UTC()
+
+	result, err := database.Collection("subscriptions").InsertOne(r.Context(), s)
+	if err != nil {
+		apierror.Backend(w, r, err)
+		return
+	}
+	s.ID = result.InsertedID.(primitive.ObjectID)
+
+	w.WriteHeader(201)
+	json.NewEncoder(w).Encode(s)
+}
+
+// List Subscriptions - Controller to get every subscription, without their secret
+func listSubscriptions(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	findOptions := options.Find().SetSort(bson.D{{Key: "createdAt", Value: 1}}).SetProjection(bson.M{"secret": 0})
+	cursor, err := database.Collection("subscriptions").Find(r.Context(), bson.M{}, findOptions)
+	if err != nil {
+		apierror.Backend(w, r, err)
+		return
+	}
+
+	subscriptions := []subscription{}
+	if err := cursor.All(r.Context(), &subscriptions); err != nil {
+		apierror.Backend(w, r, err)
+		return
+	}
+
+	json.NewEncoder(w).Encode(subscriptions)
+}
+
+// Delete Subscription - Controller to stop notifying an endpoint, its pending deliveries are failed
+func deleteSubscription(w http.ResponseWriter, r *http.Request) {
+
+	id, err := primitive.ObjectIDFromHex(mux.Vars(r)["id"])
+	if err != nil {
+		apierror.Invalid(w, r, errID)
+		return
+	}
+
+	result, err := database.Collection("subscriptions").DeleteOne(r.Context(), bson.M{"_id": id})
+	if err != nil {
+		apierror.Backend(w, r, err)
+		return
+	}
+
+	// The deliveries left pending by an interrupted deletion are failed when the deletion is retried
+	query := bson.M{"subscription": id, "status": "pending"}
+	update := bson.M{
+		"$set":  bson.M{"status": "failed"},
+		"$push": bson.M{"log": bson.M{"at": time.Now().UTC(), "error": "subscription deleted"}},
+	}
+	if _, err := database.Collection("deliveries").UpdateMany(r.Context(), query, update); err != nil {
+		apierror.Backend(w, r, err)
+		return
+	}
+	if result.DeletedCount == 0 {
+		apierror.Write(w, r, 404, "subscription not found")
+		return
+	}
+
+	w.WriteHeader(204)
+}
+
+// List Deliveries - Controller to get the delivery log of a subscription, the latest first
+// The deliveries are filtered with ?status=pending, delivered or failed
+func listDeliveries(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	id, err := primitive.ObjectIDFromHex(mux.Vars(r)["id"])
+	if err != nil {
+		apierror.Invalid(w, r, errID)
+		return
+	}
+
+	query := bson.M{"subscription": id}
+	if status := r.URL.Query().Get("status"); len(status) > 0 {
+		query["status"] = status
+	}
+	findOptions := options.Find().SetSort(bson.D{{Key: "createdAt", Value: -1}}).SetLimit(deliveryLogLimit)
+
+	cursor, err := database.Collection("deliveries").Find(r.Context(), query, findOptions)
+	if err != nil {
+		apierror.Backend(w, r, err)
+		return
+	}
+
+	deliveries := []delivery{}
+	if err := cursor.All(r.Context(), &deliveries); err != nil {
+		apierror.Backend(w, r, err)
+		return
+	}
+
+	json.NewEncoder(w).Encode(deliveries)
+}
+
+// Replay Delivery - Controller to send a delivery again as soon as possible, whatever its status, unless its subscription is deleted
+func replayDelivery(w http.ResponseWriter, r *http.Request) {
+
+	id, err := primitive.ObjectIDFromHex(mux.Vars(r)["id"])
+	if err != nil {
+		apierror.Invalid(w, r, errID)
+		return
+	}
+
+	d := delivery{}
+	err = database.Collection("deliveries").FindOne(r.Context(), bson.M{"_id": id}).Decode(&d)
+	if err == mongo.ErrNoDocuments {
+		apierror.Write(w, r, 404, "delivery not found")
+		return
+	}
+	if err != nil {
+		apierror.Backend(w, r, err)
+		return
+	}
+
+	// The deliveries are sent per subscription, the ones of a deleted subscription would never be sent
+	err = database.Collection("subscriptions").FindOne(r.Context(), bson.M{"_id": d.Subscription}).Err()
+	if err == mongo.ErrNoDocuments {
+		apierror.Write(w, r, 404, "subscription not found")
+		return
+	}
+	if err != nil {
+		apierror.Backend(w, r, err)
+		return
+	}
+
+	update := bson.M{"$set": bson.M{"status": "pending", "attempts": 0, "nextAttempt": time.Now().UTC()}}
+	if _, err := database.Collection("deliveries").UpdateOne(r.Context(), bson.M{"_id": id}, update); err != nil {
+		apierror.Backend(w, r, err)
+		return
+	}
+
+	w.WriteHeader(202)
+}
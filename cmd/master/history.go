@@ -0,0 +1,100 @@
+package main
+
+import (
+	"context"
+	"strconv"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// Retention of the history of the domains when not configured
+const defaultHistoryRetention = 90 * 24 * time.Hour
+
+// Retention of the history of the domains, the history is not written when zero
+var historyRetention time.Duration
+
+// Name of the TTL index expiring the buckets of the history
+const historyTTLIndex = "start_ttl"
+
+// Get Epoch Start - Time at which an epoch of the given length starts
+func getEpochStart(epoch string, length int64) time.Time {
+	if length <= 0 {
+		length = defaultEpochLength
+	}
+	value, _ := strconv.ParseInt(epoch, 32, 64)
+	return time.Unix(value*length, 0).UTC()
+}
+
+// Create History Indexes - One bucket per domain and hour, expired by MongoDB after the retention
+// The retention of an existing TTL index is updated in place
+func createHistoryIndexes(database *mongo.Database) error {
+
+	collection := database.Collection("history")
+	expiration := int32(historyRetention / time.Second)
+
+	_, err := collection.Indexes().CreateOne(context.TODO(), mongo.IndexModel{
+		Keys:    bson.D{{Key: "name", Value: 1}, {Key: "start", Value: 1}},
+		Options: options.Index().SetUnique(true),
+	})
+	if err != nil {
+		return err
+	}
+
+	_, err = collection.Indexes().CreateOne(context.TODO(), mongo.IndexModel{
+		Keys:    bson.D{{Key: "start", Value: 1}},
+		Options: options.Index().SetName(historyTTLIndex).SetExpireAfterSeconds(expiration),
+	})
+	if err == nil {
+		return nil
+	}
+
+	command := bson.D{
+		{Key: "collMod", Value: "history"},
+		{Key: "index", Value: bson.D{{Key: "name", Value: historyTTLIndex}, {Key: "expireAfterSeconds", Value: expiration}}},
+	}
+
+	return database.RunCommand(context.TODO(), command).Err()
+}
+
+// Update History - Add the counters of a period to the hourly buckets of the domains
+func updateHistory(ctx context.Context, database *mongo.Database, page domains, start time.Time) error {
+
+	if historyRetention <= 0 {
+		return nil
+	}
+
+	var operations []mongo.WriteModel
+
+	bulkOption := options.BulkWriteOptions{}
+	bulkOption.SetOrdered(true)
+
+	hour := start.Truncate(time.Hour)
+
+	for _, d := range page {
+		if len(d.counters) == 0 {
+			continue
+		}
+
+		counters := bson.M{}
+		for t, count := range d.counters {
+			counters["counters."+t] = count
+		}
+
+		operation := mongo.NewUpdateOneModel()
+		operation.SetFilter(bson.M{"name": d.name, "start": hour})
+		operation.SetUpdate(bson.M{"$inc": counters})
+		operation.SetUpsert(true)
+		operations = append(operations, operation)
+	}
+
+	if len(operations) == 0 {
+		return nil
+	}
+
+	_, err := database.Collection("history").BulkWrite(ctx, operations, &bulkOption)
+
+	return err
+}
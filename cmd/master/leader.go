@@ -0,0 +1,128 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"os"
+	"time"
+
+	"catchall/internal/storage"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// Identifier of the lease shared by the aggregator services
+const leaseID = "aggregator"
+
+// Duration of the lease, renewed three times per duration by its holder
+// A standby takes over at most a duration and a renewal interval after the holder disappears
+var leaseDuration = 15 * time.Second
+
+var errLeaseLost = errors.New("lease held by another aggregator service")
+
+// Lease - Holder of the aggregation and the fencing token incremented at every change of holder
+type lease struct {
+	Holder    string    `bson:"holder"`
+	Token     int64     `bson:"token"`
+	ExpiresAt time.Time `bson:"expiresAt"`
+}
+
+// Instance ID - Identifier of the aggregator service holding the lease
+func instanceID() string {
+	host, _ := os.Hostname()
+	b := make([]byte, 4)
+	rand.Read(b)
+	return fmt.Sprintf("%s-%d-%s", host, os.Getpid(), hex.EncodeToString(b))
+}
+
+// Run Election - Run the jobs while holding the lease, standing by otherwise
+// The jobs are stopped as soon as the lease can't be renewed
+func runElection(database *mongo.Database, store storage.Store, members *membership) {
+
+	id := instanceID()
+	interval := leaseDuration / 3
+
+	fmt.Println("* Application stands by for the aggregation lease as", id)
+
+	for {
+		l, err := acquireLease(database, id)
+		if err != nil {
+			fmt.Println("* Lease not acquired :", err)
+		}
+		if l == nil {
+			time.Sleep(interval)
+			continue
+		}
+		fmt.Println("* Lease acquired, fencing token", l.Token)
+
+		ctx, cancel := context.WithCancel(context.Background())
+		go runJobs(ctx, store, members, l.Token)
+
+		for {
+			time.Sleep(interval)
+
+			err := renewLease(database, id, l)
+			if err == nil {
+				continue
+			}
+			if err == errLeaseLost || time.Now().After(l.ExpiresAt) {
+				fmt.Println("* Lease lost :", err)
+				break
+			}
+			fmt.Println("* Lease not renewed :", err)
+		}
+
+		cancel()
+	}
+}
+
+// Acquire Lease - Take the lease when it is free or expired, with a new fencing token
+// No lease is returned while another aggregator service holds it
+func acquireLease(database *mongo.Database, id string) (*lease, error) {
+
+	now := time.Now().UTC()
+	query := bson.M{"_id": leaseID, "expiresAt": bson.M{"$lt": now}}
+	update := bson.M{
+		"$set": bson.M{"holder": id, "expiresAt": now.Add(leaseDuration)},
+		"$inc": bson.M{"token": int64(1)},
+	}
+	updateOptions := options.FindOneAndUpdate().SetUpsert(true).SetReturnDocument(options.After)
+
+	l := &lease{}
+	err := database.Collection("leases").FindOneAndUpdate(context.TODO(), query, update, updateOptions).Decode(l)
+
+	// The lease exists and has not expired, the upsert conflicts with it
+	if mongo.IsDuplicateKeyError(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	return l, nil
+}
+
+// Renew Lease - Extend the lease as long as it is still held with the same fencing token
+func renewLease(database *mongo.Database, id string, l *lease) error {
+
+	expiresAt := time.Now().UTC().Add(leaseDuration)
+	query := bson.M{"_id": leaseID, "holder": id, "token": l.Token}
+	update := bson.M{"$set": bson.M{"expiresAt": expiresAt}}
+
+	result, err := database.Collection("leases").UpdateOne(context.TODO(), query, update)
+	if err != nil {
+		return err
+	}
+	if result.MatchedCount == 0 {
+		return errLeaseLost
+	}
+
+	l.ExpiresAt = expiresAt
+
+	return nil
+}
@@ -2,30 +2,69 @@ package main
 
 import (
 	"context"
+	"errors"
+	"flag"
 	"fmt"
 	"os"
 	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 
-	"github.com/tidwall/tinybtree"
+	"catchall/internal/policy"
+	"catchall/internal/storage"
+
 	"github.com/tidwall/uhatools"
 
-	"go.mongodb.org/mongo-driver/bson"
 	"go.mongodb.org/mongo-driver/mongo"
-	"go.mongodb.org/mongo-driver/mongo/options"
 )
 
 type domain struct {
-	name      string
-	delivered int64
-	bounced   int64
+	name     string
+	counters map[string]int64
 }
 
 type domains []domain
 
-func getEpoch(now time.Time) string {
-	return strconv.FormatInt(now.Unix()/30, 32)
+// A worker is a cluster identified by its list of servers
+type worker struct {
+	// The 64-bit fields used atomically come first to be aligned on the 32-bit platforms
+	length  int64 // epoch length in seconds, read from the cluster
+	running int32 // set while the cluster is being aggregated
+
+	name    string
+	cluster *uhatools.Cluster
+
+	draining  int32     // set once the cluster is removed from the source of the clusters
+	drainedBy time.Time // time after which a draining cluster is dropped
+}
+
+// Information of a cluster, current and retrieved are empty before the first increment
+type information struct {
+	current   string
+	retrieved string
+	length    int64
+}
+
+// Length of the epochs in seconds for the clusters not exposing it
+const defaultEpochLength = 30
+
+var errCommitted = errors.New("epoch already committed")
+var errInformation = errors.New("invalid cluster information")
+var errPage = errors.New("invalid cluster page")
+
+// Number of domains retrieved at once from the clusters
+const pageSize = 1000
+
+// Time given to a cluster to report its information or to commit one of its periods
+var clusterTimeout = time.Minute
+
+// Delay after the end of an epoch before it is aggregated, for the clocks of the cluster leaders being late
+var gracePeriod = 5 * time.Second
+
+func getEpoch(now time.Time, length int64) string {
+	return strconv.FormatInt(now.Unix()/length, 32)
 }
 
 func nextEpoch(current string) string {
@@ -38,56 +77,109 @@ func previousEpoch(current string) string {
 	return strconv.FormatInt(epoch-1, 32)
 }
 
+func parseEpoch(epoch string) int64 {
+	value, _ := strconv.ParseInt(epoch, 32, 64)
+	return value
+}
+
+func formatEpoch(epoch int64) string {
+	return strconv.FormatInt(epoch, 32)
+}
+
 func main() {
 
-	if len(os.Args) < 3 {
-		fmt.Fprintf(os.Stderr, "Specify the address of the main database and the cluster servers")
+	retention := flag.Duration("history", defaultHistoryRetention, "retention of the hourly history of the domains, 0 to disable it")
+	flag.DurationVar(&leaseDuration, "lease", leaseDuration, "duration of the aggregation lease, a standby service takes over after it")
+	flag.DurationVar(&gracePeriod, "grace", gracePeriod, "delay after the end of an epoch before it is aggregated")
+	flag.DurationVar(&clusterTimeout, "timeout", clusterTimeout, "time given to a cluster to commit a period before it is retried at the next run")
+	flag.DurationVar(&drainTimeout, "drain", drainTimeout, "time given to a removed cluster to commit its remaining epochs")
+	policyPath := flag.String("policy", "", "path of the JSON classification policy used to detect the status changes, as in master-api")
+	source := flag.String("clusters", "", "path of the JSON array of the clusters, or mongodb for the clusters collection, read again every 5 seconds")
+	flag.Parse()
+
+	args := flag.Args()
+	if len(args) < 1 || (len(args) < 2 && len(*source) == 0) {
+		fmt.Fprintf(os.Stderr, "Specify the address of the main database, or bolt:<path> for an embedded file, and the cluster servers")
 		os.Exit(1)
 	}
 	var err error
 
 	fmt.Println("\n# Starting 'CatchAll - Aggregator Service' application")
-	fmt.Println("* Application try connection to the master database", os.Args[1])
+	fmt.Println("* Application try connection to the master database", args[0])
 
-	database, err := connectDB(os.Args[1])
+	store, err := storage.Open(args[0])
 	if err != nil {
+		fmt.Println("* Failed to open the master database :", err)
 		return
 	}
+	defer store.Close()
+	fmt.Println("* Connected to the master DB")
 
-	nCluster := len(os.Args[2:])
-	workers := make([]*uhatools.Cluster, nCluster)
-
-	for idx := 0; idx < nCluster; idx++ {
-
-		servers := strings.Split(os.Args[idx+2], ",")
+	// The history, the webhooks and the lease are only kept in MongoDB
+	database := storage.Database(store)
+	if database == nil {
+		fmt.Println("* Application runs without history, webhooks nor standby, the database is not MongoDB")
+	}
 
-		fmt.Println("* Application try connection to the database cluster", servers)
+	if len(*policyPath) > 0 {
+		fmt.Println("* Application loads the classification policy", *policyPath)
+		if err = policy.Watch(*policyPath); err != nil {
+			fmt.Fprintln(os.Stderr, "Invalid classification policy :", err)
+			os.Exit(1)
+		}
+	}
 
-		workers[idx], err = connectDBCluster(servers)
-		if err != nil {
+	historyRetention = *retention
+	if database == nil {
+		historyRetention = 0
+	}
+	if historyRetention > 0 {
+		fmt.Println("* Application keeps the history of the domains for", historyRetention)
+		if err = createHistoryIndexes(database); err != nil {
+			fmt.Println("* Failed to create the history indexes :", err)
 			return
 		}
-		defer workers[idx].Close()
 	}
 
-	runJobs(database, workers)
-}
-
-// Connect DB - Connect the master to an in-memory fault tolerant worker database
-func connectDB(address string) (*mongo.Database, error) {
+	if database != nil {
+		if err = createDeliveryIndexes(database); err != nil {
+			fmt.Println("* Failed to create the delivery indexes :", err)
+			return
+		}
+	}
 
-	clientOptions := options.Client().ApplyURI("mongodb://" + address)
-	client, err := mongo.Connect(context.TODO(), clientOptions)
+	// The clusters given at startup are always aggregated, the ones of the source follow its changes
+	members := newMembership()
 
-	if err != nil {
-		return nil, err
+	for _, name := range args[1:] {
+		if err = members.add(name, true); err != nil {
+			return
+		}
 	}
 
-	fmt.Println("* Connected to the master DB")
+	if len(*source) > 0 {
+		if *source == membershipCollection && database == nil {
+			fmt.Fprintln(os.Stderr, "The clusters collection is only kept in MongoDB")
+			os.Exit(1)
+		}
+		fmt.Println("* Application reads the clusters from", *source)
+		names, err := readMembership(*source, database)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, "Invalid clusters :", err)
+			os.Exit(1)
+		}
+		members.reconcile(names)
+		go watchMembership(members, *source, database)
+	}
 
-	db := client.Database("catchall")
+	// A single aggregator service runs without lease, its fencing token is zero
+	if database == nil {
+		runJobs(context.Background(), store, members, 0)
+		return
+	}
 
-	return db, nil
+	go runWebhooks(database)
+	runElection(database, store, members)
 }
 
 // Connect DB Cluster - Connect the master to an in-memory fault tolerant worker database
@@ -121,146 +213,379 @@ func pingDBCluster(cl *uhatools.Cluster) error {
 	return nil
 }
 
-// Run jobs - Periodically run an aggregation of statistics
-// TODO - Catch-up the statistics when started and use the extract command
-// instead of scan to expire the data on the workers
-func runJobs(database *mongo.Database, workers []*uhatools.Cluster) {
+// Run jobs - Run an aggregation of statistics at the start and after the end of every epoch
+// while the lease of the fencing token is held
+// The clusters added meanwhile are aggregated from the next run
+func runJobs(ctx context.Context, store storage.Store, members *membership, token int64) {
 
 	for {
-		go func() {
-			epoch := previousEpoch(getEpoch(time.Now()))
-			period, err := aggregatePeriod(workers, epoch)
-			if err != nil || period.Len() == 0 {
+		go catchUp(ctx, store, members, token)
+
+		select {
+		case <-time.After(time.Until(getNextRun(members.list(), time.Now()))):
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// Get Next Run - Earliest end of an epoch of the clusters after now, delayed by the grace period
+func getNextRun(workers []*worker, now time.Time) time.Time {
+
+	var next time.Time
+
+	for _, worker := range workers {
+		length := atomic.LoadInt64(&worker.length)
+		if length <= 0 {
+			length = defaultEpochLength
+		}
+
+		// The epochs are aligned on the unix time, the current one ends after the grace period
+		elapsed := now.Add(-gracePeriod).Unix()
+		run := time.Unix(elapsed-elapsed%length+length, 0).Add(gracePeriod)
+		if next.IsZero() || run.Before(next) {
+			next = run
+		}
+	}
+	if next.IsZero() {
+		next = now.Add(defaultEpochLength * time.Second)
+	}
+
+	return next
+}
+
+// Catch Up - Aggregate the clusters concurrently, each one committing its own periods
+// A cluster failing or timing out only delays its own periods, retried at the next run,
+// and a cluster still catching up from a previous run is skipped
+// A draining cluster is dropped once all its epochs are committed
+func catchUp(ctx context.Context, store storage.Store, members *membership, token int64) {
+
+	var wg sync.WaitGroup
+
+	for _, w := range members.list() {
+
+		if !atomic.CompareAndSwapInt32(&w.running, 0, 1) {
+			continue
+		}
+
+		wg.Add(1)
+		go func(w *worker) {
+			defer wg.Done()
+			defer atomic.StoreInt32(&w.running, 0)
+
+			err := catchUpCluster(ctx, store, w, token)
+			if err != nil {
+				fmt.Println("* Catch-up of the cluster", w.name, "interrupted :", err)
 				return
 			}
-			err = updateDomains(database, period)
-			if err != nil {
+			if atomic.LoadInt32(&w.draining) == 0 {
 				return
 			}
-		}()
-		time.Sleep(30 * time.Second)
-	}
-}
 
-// Update Domains - Update the domains in the database using bulk write
-func updateDomains(database *mongo.Database, period *tinybtree.BTree) error {
+			drained, err := isDrained(ctx, store, w)
+			if err != nil {
+				fmt.Println("* Drain of the cluster", w.name, "not checked :", err)
+			}
+			if drained {
+				fmt.Println("* Cluster drained :", w.name)
+				members.drop(w)
+			}
+		}(w)
+	}
 
-	var operations []mongo.WriteModel
-	var count int
+	wg.Wait()
+}
 
-	bulkOption := options.BulkWriteOptions{}
-	bulkOption.SetOrdered(true)
+// Catch Up Cluster - Aggregate in order every closed period of the cluster not yet committed
+// The periods before the current epoch of the cluster are closed, the clock of its leader being the reference
+func catchUpCluster(ctx context.Context, store storage.Store, worker *worker, token int64) error {
 
-	period.Scan(func(name string, v interface{}) bool {
-		d := v.(*domain)
+	infoCtx, cancel := context.WithTimeout(ctx, clusterTimeout)
+	defer cancel()
 
-		operation := mongo.NewUpdateOneModel()
-		operation.SetFilter(bson.M{"name": d.name})
-		operation.SetUpdate(bson.M{"$inc": bson.M{"delivered": d.delivered, "bounced": d.bounced}})
-		operation.SetUpsert(true)
-		operations = append(operations, operation)
+	// The clusters not supporting TICK close their epochs on the next increment only
+	doCluster(infoCtx, worker.cluster, "TICK")
 
-		count++
+	info, err := getInformation(infoCtx, worker.cluster)
+	if err != nil {
+		return err
+	}
+	atomic.StoreInt64(&worker.length, info.length)
 
-		return true
-	})
+	// Nothing has been written in the cluster yet
+	if len(info.current) == 0 {
+		return nil
+	}
 
-	_, err := database.Collection("domains").BulkWrite(context.TODO(), operations, &bulkOption)
+	// Resume after the watermark, the periods before the retrieved one are already expired
+	retrieved := parseEpoch(info.retrieved)
+	committed, found, err := store.Watermark(ctx, worker.name)
 	if err != nil {
 		return err
 	}
-	fmt.Println("* Domains upserted in the database :", count)
+
+	var from int64
+	switch {
+	case !found:
+		from = retrieved + 1
+	case committed.Epoch < retrieved:
+		from = retrieved
+	default:
+		from = committed.Epoch + 1
+	}
+
+	// The period partially committed resumes after its last page committed
+	cursor := ""
+	if found && committed.Epoch+1 == from {
+		cursor = committed.Cursor
+	}
+
+	to := parseEpoch(info.current) - 1
+
+	for epoch := from; epoch <= to; epoch++ {
+
+		err := commitPeriod(ctx, store, worker, epoch, cursor, token)
+		cursor = ""
+
+		// Another aggregator service committed the cluster meanwhile, it is resumed at the next run
+		if errors.Is(err, errCommitted) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+	}
 
 	return nil
 }
 
-// Aggregate Period - Create a single period from different clusters
-func aggregatePeriod(workers []*uhatools.Cluster, epoch string) (*tinybtree.BTree, error) {
+// Commit Period - Stream the period of the cluster into the database page by page from the cursor
+// Each page is committed with the watermark of the cluster in its own transaction, so that the transactions
+// stay short whatever the size of the period, and a period interrupted resumes after its last page committed
+func commitPeriod(ctx context.Context, store storage.Store, worker *worker, epoch int64, cursor string, token int64) error {
 
-	aggregatedPeriod := &tinybtree.BTree{}
-	parts := make([]int64, len(workers))
+	var part int64
+	database := storage.Database(store)
+	start := getEpochStart(formatEpoch(epoch), atomic.LoadInt64(&worker.length))
 
-	for idx, worker := range workers {
-
-		part, err := scanPeriod(worker, epoch)
+	for {
+		pageCtx, cancel := context.WithTimeout(ctx, clusterTimeout)
+		next, count, err := commitPage(pageCtx, store, database, worker, epoch, cursor, start, token)
+		cancel()
 		if err != nil {
-			return nil, err
+			return err
 		}
+		part += count
 
-		for i, n := 0, 0; i < len(part)/3; i, n = i+1, n+3 {
+		if len(next) == 0 {
+			break
+		}
+		cursor = next
+	}
 
-			var d *domain
+	fmt.Println("* New period aggregated from the cluster", worker.name, ":", part)
 
-			name := part[n]
-			delivered, _ := strconv.Atoi(part[n+1])
-			bounced, _ := strconv.Atoi(part[n+2])
+	return nil
+}
 
-			v, existed := aggregatedPeriod.Get(name)
+// Commit Page - Extract a page of the period and commit it with the watermark of the cluster
+// The page is read before the transaction, which is aborted when the watermark moved meanwhile
+// or when a newer fencing token has committed the cluster
+// The cursor of the next page and the sum of the counters of the page are returned
+func commitPage(ctx context.Context, store storage.Store, database *mongo.Database, worker *worker, epoch int64, cursor string, start time.Time, token int64) (string, int64, error) {
 
-			if !existed {
-				d = new(domain)
-				d.name = name
-				d.delivered = 0
-				d.bounced = 0
-			} else {
-				d = v.(*domain)
-			}
+	items, next, err := extractPeriod(ctx, worker.cluster, formatEpoch(epoch), cursor)
+	if err != nil {
+		return "", 0, err
+	}
+	page := parsePage(items)
+
+	// The epoch is committed with its last page, the cursor of the next page is kept otherwise
+	watermark := storage.Watermark{Epoch: epoch}
+	if len(next) > 0 {
+		watermark = storage.Watermark{Epoch: epoch - 1, Cursor: next}
+	}
 
-			d.delivered += int64(delivered)
-			d.bounced += int64(bounced)
+	err = store.Update(ctx, func(tx storage.Tx) error {
 
-			parts[idx] += int64(delivered) + int64(bounced)
+		committed, found, err := tx.Watermark(worker.name)
+		if err != nil {
+			return err
+		}
+		if found && (committed.Epoch >= epoch || (committed.Epoch == epoch-1 && committed.Cursor != cursor)) {
+			return errCommitted
+		}
 
-			aggregatedPeriod.Set(d.name, d)
+		err = aggregatePage(tx, database, page, formatEpoch(epoch), start)
+		if err != nil {
+			return err
 		}
+
+		return tx.SetWatermark(worker.name, watermark, token)
+	})
+	if err != nil {
+		return "", 0, err
 	}
 
-	fmt.Println("* New period aggregated :", parts)
+	var count int64
+	for _, d := range page {
+		for _, c := range d.counters {
+			count += c
+		}
+	}
 
-	return aggregatedPeriod, nil
+	return next, count, nil
 }
 
-// Get Information - Retrieve cluster period information [current] [last retrieved]
-func getInformation(worker *uhatools.Cluster) ([]string, error) {
+// Update Domains - Add the counters of the page to the domains
+// The start of the period is kept as the last time the domain was seen
+func updateDomains(tx storage.Tx, page domains, start time.Time) error {
 
-	conn := worker.Get()
-	defer conn.Close()
+	increments := make([]storage.Increment, 0, len(page))
+	for _, d := range page {
+		increments = append(increments, storage.Increment{Name: d.name, Counters: d.counters, Seen: start})
+	}
+
+	return tx.Increment(increments)
+}
+
+// Aggregate Page - Add a page of the period to the domains and to their history
+// The status changes of the page are queued to the subscriptions, with MongoDB only
+func aggregatePage(tx storage.Tx, database *mongo.Database, page domains, epoch string, start time.Time) error {
 
-	resp, err := uhatools.String(conn.Do("DBINFO"))
+	ctx := tx.Context()
+	if database == nil {
+		return updateDomains(tx, page, start)
+	}
+
+	subscriptions, err := getSubscriptions(ctx, database)
 	if err != nil {
-		fmt.Println(err)
-		return nil, err
+		return err
+	}
+
+	changed := make(changes)
+	if len(subscriptions) > 0 {
+		err = changed.observe(ctx, database, page, epoch)
+		if err != nil {
+			return err
+		}
+	}
+
+	err = updateDomains(tx, page, start)
+	if err != nil {
+		return err
 	}
 
-	return strings.Split(resp, " "), nil
+	err = updateHistory(ctx, database, page, start)
+	if err != nil {
+		return err
+	}
+
+	return changed.queue(ctx, database, subscriptions)
 }
 
-// Scan Period - Retrieve cluster period statistics
-func scanPeriod(worker *uhatools.Cluster, epoch string) ([]string, error) {
+// Parse Page - Each domain is its name, its number of counters and the type and count pairs
+func parsePage(part []string) domains {
 
-	conn := worker.Get()
-	defer conn.Close()
+	var page domains
+
+	for n := 0; n+1 < len(part); {
+
+		d := domain{name: part[n], counters: make(map[string]int64)}
+		count, _ := strconv.Atoi(part[n+1])
+		n += 2
+
+		for i := 0; i < count && n+1 < len(part); i, n = i+1, n+2 {
+			value, _ := strconv.ParseInt(part[n+1], 10, 64)
+			d.counters[part[n]] += value
+		}
+
+		page = append(page, d)
+	}
+
+	return page
+}
+
+// Do Cluster - Run a command on the cluster, giving up when the context is done
+// The command abandoned completes in the background
+func doCluster(ctx context.Context, cluster *uhatools.Cluster, command string, args ...interface{}) (interface{}, error) {
+
+	type result struct {
+		reply interface{}
+		err   error
+	}
+	done := make(chan result, 1)
+
+	go func() {
+		conn := cluster.Get()
+		defer conn.Close()
+
+		reply, err := conn.Do(command, args...)
+		done <- result{reply, err}
+	}()
 
-	resp, err := uhatools.Strings(conn.Do("SCAN", epoch))
+	select {
+	case r := <-done:
+		return r.reply, r.err
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+// Get Information - Retrieve cluster period information [current] [last retrieved] [epoch length]
+func getInformation(ctx context.Context, worker *uhatools.Cluster) (*information, error) {
+
+	resp, err := uhatools.String(doCluster(ctx, worker, "DBINFO"))
 	if err != nil {
 		fmt.Println(err)
 		return nil, err
 	}
 
-	return resp, nil
+	fields := strings.Split(resp, " ")
+	if len(fields) < 2 {
+		return nil, errInformation
+	}
+
+	info := &information{length: defaultEpochLength}
+	if fields[0] != "<nil>" {
+		info.current, info.retrieved = fields[0], fields[1]
+	}
+	if len(fields) > 2 {
+		info.length, err = strconv.ParseInt(fields[2], 10, 64)
+		if err != nil || info.length <= 0 {
+			return nil, errInformation
+		}
+	}
+
+	return info, nil
 }
 
-// Extract Period - Retrieve cluster period statistics and expire the previous period
-func extractPeriod(worker *uhatools.Cluster, epoch string) ([]string, error) {
+// Scan Period - Retrieve a page of cluster period statistics and the cursor of the next page
+func scanPeriod(ctx context.Context, worker *uhatools.Cluster, epoch string, cursor string) ([]string, string, error) {
 
-	conn := worker.Get()
-	defer conn.Close()
+	resp, err := uhatools.Strings(doCluster(ctx, worker, "SCAN", epoch, "CURSOR", cursor, "COUNT", pageSize))
+	if err != nil {
+		fmt.Println(err)
+		return nil, "", err
+	}
+	if len(resp) == 0 {
+		return nil, "", errPage
+	}
 
-	resp, err := uhatools.Strings(conn.Do("EXTRACT", epoch))
+	return resp[1:], resp[0], nil
+}
+
+// Extract Period - Retrieve a page of cluster period statistics and expire the previous period
+func extractPeriod(ctx context.Context, worker *uhatools.Cluster, epoch string, cursor string) ([]string, string, error) {
+
+	resp, err := uhatools.Strings(doCluster(ctx, worker, "EXTRACT", epoch, "CURSOR", cursor, "COUNT", pageSize))
 	if err != nil {
 		fmt.Println(err)
-		return nil, err
+		return nil, "", err
+	}
+	if len(resp) == 0 {
+		return nil, "", errPage
 	}
 
-	return resp, nil
+	return resp[1:], resp[0], nil
 }
@@ -0,0 +1,237 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"catchall/internal/storage"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+// Source of the clusters read from the clusters collection of the master database instead of a file
+const membershipCollection = "mongodb"
+
+// Interval between two reads of the source of the clusters
+const membershipInterval = 5 * time.Second
+
+// Time given to a removed cluster to commit its remaining epochs before it is dropped anyway
+var drainTimeout = time.Hour
+
+// Membership - Clusters aggregated, the ones given at startup and the ones of the source
+// A cluster removed from the source is drained before being disconnected
+type membership struct {
+	mu      sync.Mutex
+	static  map[string]bool
+	workers map[string]*worker
+}
+
+func newMembership() *membership {
+	return &membership{static: make(map[string]bool), workers: make(map[string]*worker)}
+}
+
+// List - Clusters to aggregate, sorted by name
+func (m *membership) list() []*worker {
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	workers := make([]*worker, 0, len(m.workers))
+	for _, w := range m.workers {
+		workers = append(workers, w)
+	}
+	sort.Slice(workers, func(i, j int) bool { return workers[i].name < workers[j].name })
+
+	return workers
+}
+
+// Add - Connect to a cluster and aggregate it
+func (m *membership) add(name string, static bool) error {
+
+	servers := strings.Split(name, ",")
+
+	fmt.Println("* Application try connection to the database cluster", servers)
+
+	cluster, err := connectDBCluster(servers)
+	if err != nil {
+		return err
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), clusterTimeout)
+	defer cancel()
+
+	info, err := getInformation(ctx, cluster)
+	if err != nil {
+		cluster.Close()
+		return err
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.workers[name] = &worker{name: name, cluster: cluster, length: info.length}
+	if static {
+		m.static[name] = true
+	}
+
+	return nil
+}
+
+// Drop - Stop aggregating a draining cluster and disconnect from it
+// Nothing is done when the cluster was added back meanwhile
+func (m *membership) drop(w *worker) {
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if m.workers[w.name] != w || atomic.LoadInt32(&w.draining) == 0 {
+		return
+	}
+	delete(m.workers, w.name)
+	w.cluster.Close()
+
+	fmt.Println("* Disconnected from the DB cluster", w.name)
+}
+
+// Reconcile - Connect to the clusters added to the source and drain the ones removed
+// A cluster which can't be reached is tried again at the next read of the source
+func (m *membership) reconcile(names []string) {
+
+	wanted := make(map[string]bool, len(names))
+	for _, name := range names {
+		wanted[name] = true
+	}
+
+	m.mu.Lock()
+	var added []string
+	for name := range wanted {
+		w, found := m.workers[name]
+		if !found {
+			added = append(added, name)
+			continue
+		}
+		if atomic.CompareAndSwapInt32(&w.draining, 1, 0) {
+			fmt.Println("* Cluster added back before being drained :", name)
+		}
+	}
+
+	var expired []*worker
+	now := time.Now()
+	for name, w := range m.workers {
+		if wanted[name] || m.static[name] {
+			continue
+		}
+		if atomic.CompareAndSwapInt32(&w.draining, 0, 1) {
+			w.drainedBy = now.Add(drainTimeout)
+			fmt.Println("* Cluster removed, draining its remaining epochs :", name)
+		} else if now.After(w.drainedBy) {
+			expired = append(expired, w)
+		}
+	}
+	m.mu.Unlock()
+
+	for _, w := range expired {
+		fmt.Println("* Cluster not drained in time, its remaining epochs are dropped :", w.name)
+		m.drop(w)
+	}
+
+	sort.Strings(added)
+	for _, name := range added {
+		if err := m.add(name, false); err != nil {
+			fmt.Println("* Cluster not added :", name, err)
+		}
+	}
+}
+
+// Watch Membership - Read the clusters from the source periodically, a file or the clusters collection
+// The source which can't be read keeps the current clusters
+func watchMembership(m *membership, source string, database *mongo.Database) {
+
+	for {
+		names, err := readMembership(source, database)
+		if err != nil {
+			fmt.Println("* Clusters not reloaded :", err)
+		} else {
+			m.reconcile(names)
+		}
+		time.Sleep(membershipInterval)
+	}
+}
+
+// Read Membership - Names of the clusters, a JSON array of server lists in a file
+// or the documents { _id: "<servers>" } of the clusters collection
+func readMembership(source string, database *mongo.Database) ([]string, error) {
+
+	var names []string
+
+	if source != membershipCollection {
+		data, err := ioutil.ReadFile(source)
+		if err != nil {
+			return nil, err
+		}
+		if err := json.Unmarshal(data, &names); err != nil {
+			return nil, err
+		}
+		return names, nil
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), membershipInterval)
+	defer cancel()
+
+	cursor, err := database.Collection("clusters").Find(ctx, bson.M{})
+	if err != nil {
+		return nil, err
+	}
+
+	var documents []struct {
+		ID string `bson:"_id"`
+	}
+	if err := cursor.All(ctx, &documents); err != nil {
+		return nil, err
+	}
+	for _, d := range documents {
+		names = append(names, d.ID)
+	}
+
+	return names, nil
+}
+
+// Is Drained - Whether every epoch of the cluster is committed, its current epoch being closed and empty
+// The current epoch is moved by TICK once the cluster receives no more events
+func isDrained(ctx context.Context, store storage.Store, w *worker) (bool, error) {
+
+	ctx, cancel := context.WithTimeout(ctx, clusterTimeout)
+	defer cancel()
+
+	info, err := getInformation(ctx, w.cluster)
+	if err != nil {
+		return false, err
+	}
+	if len(info.current) == 0 {
+		return true, nil
+	}
+
+	items, _, err := scanPeriod(ctx, w.cluster, info.current, "")
+	if err != nil || len(items) > 0 {
+		return false, err
+	}
+
+	watermark, found, err := store.Watermark(ctx, w.name)
+	if err != nil {
+		return false, err
+	}
+	committed := watermark.Epoch
+	if !found {
+		committed = parseEpoch(info.retrieved)
+	}
+
+	return committed >= parseEpoch(info.current)-1, nil
+}
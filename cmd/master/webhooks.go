@@ -0,0 +1,358 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"catchall/internal/policy"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// Delivery of the webhooks
+const (
+	webhookInterval = time.Second      // interval between two checks of the pending deliveries
+	webhookLease    = time.Minute      // time during which a delivery being sent is not picked again
+	webhookTimeout  = 10 * time.Second // time given to an endpoint to answer
+	webhookWorkers  = 16               // subscriptions sent to at once
+	webhookBatch    = 100              // deliveries sent to a subscription before giving its worker to the others
+	retryBase       = 10 * time.Second // delay before the first retry, doubled at each attempt
+	retryMax        = time.Hour        // longest delay between two attempts
+	maxAttempts     = 10               // attempts before a delivery is failed
+)
+
+// Statuses of the deliveries
+const (
+	deliveryPending   = "pending"
+	deliveryDelivered = "delivered"
+	deliveryFailed    = "failed"
+)
+
+var errSubscription = errors.New("subscription deleted")
+
+var webhookClient = &http.Client{Timeout: webhookTimeout}
+
+// Subscription - Endpoint notified of the status changes, the secret signs the callbacks
+type subscription struct {
+	ID     primitive.ObjectID `bson:"_id"`
+	URL    string             `bson:"url"`
+	Secret string             `bson:"secret"`
+}
+
+// Change - Status of a domain before and after a period
+type change struct {
+	Domain string    `json:"domain" bson:"domain"`
+	From   string    `json:"from"   bson:"from"`
+	To     string    `json:"to"     bson:"to"`
+	Epoch  string    `json:"epoch"  bson:"epoch"`
+	At     time.Time `json:"at"     bson:"at"`
+}
+
+// Delivery - Change sent to a subscription and the log of its attempts
+type delivery struct {
+	ID           primitive.ObjectID `bson:"_id,omitempty"`
+	Subscription primitive.ObjectID `bson:"subscription"`
+	Event        change             `bson:"event"`
+	Status       string             `bson:"status"`
+	Attempts     int                `bson:"attempts"`
+	NextAttempt  time.Time          `bson:"nextAttempt"`
+	CreatedAt    time.Time          `bson:"createdAt"`
+	Log          []attempt          `bson:"log"`
+}
+
+type attempt struct {
+	At         time.Time `bson:"at"`
+	StatusCode int       `bson:"statusCode,omitempty"`
+	Error      string    `bson:"error,omitempty"`
+}
+
+// Changes - Status changes of the domains of a page, from the status before the page to the one after it
+// A domain appears in a single page of a period
+type changes map[string]*change
+
+// Create Delivery Indexes - Indexes of the pending deliveries and of the delivery log of the subscriptions
+// The collections are also created before being written in the transactions
+func createDeliveryIndexes(database *mongo.Database) error {
+
+	_, err := database.Collection("deliveries").Indexes().CreateMany(context.TODO(), []mongo.IndexModel{
+		{Keys: bson.D{{Key: "status", Value: 1}, {Key: "nextAttempt", Value: 1}}},
+		{Keys: bson.D{{Key: "subscription", Value: 1}, {Key: "createdAt", Value: -1}}},
+	})
+	if err != nil {
+		return err
+	}
+
+	_, err = database.Collection("subscriptions").Indexes().CreateOne(context.TODO(), mongo.IndexModel{
+		Keys: bson.D{{Key: "createdAt", Value: 1}},
+	})
+
+	return err
+}
+
+// Get Subscriptions - Every endpoint to notify
+func getSubscriptions(ctx context.Context, database *mongo.Database) ([]subscription, error) {
+
+	cursor, err := database.Collection("subscriptions").Find(ctx, bson.M{})
+	if err != nil {
+		return nil, err
+	}
+
+	var subscriptions []subscription
+	err = cursor.All(ctx, &subscriptions)
+
+	return subscriptions, err
+}
+
+// Observe - Classify the domains of a page before and after their counters are added
+// Called before the page is written in the database
+func (c changes) observe(ctx context.Context, database *mongo.Database, page domains, epoch string) error {
+
+	if len(page) == 0 {
+		return nil
+	}
+
+	names := make([]string, 0, len(page))
+	for _, d := range page {
+		names = append(names, d.name)
+	}
+
+	query := bson.M{"name": bson.M{"$in": names}}
+	projection := options.Find().SetProjection(bson.M{"_id": 0, "name": 1, "delivered": 1, "bounced": 1})
+
+	cursor, err := database.Collection("domains").Find(ctx, query, projection)
+	if err != nil {
+		return err
+	}
+
+	var stored []struct {
+		Name      string `bson:"name"`
+		Delivered int64  `bson:"delivered"`
+		Bounced   int64  `bson:"bounced"`
+	}
+	if err := cursor.All(ctx, &stored); err != nil {
+		return err
+	}
+
+	before := make(map[string][2]int64, len(stored))
+	for _, s := range stored {
+		before[s.Name] = [2]int64{s.Delivered, s.Bounced}
+	}
+
+	active := policy.Active()
+	now := time.Now().UTC()
+
+	for _, d := range page {
+		rule := active.RuleFor(d.name)
+		counts := before[d.name]
+		from := rule.Classify(counts[0], counts[1])
+		to := rule.Classify(counts[0]+d.counters["delivered"], counts[1]+d.counters["bounced"])
+
+		if from != to {
+			c[d.name] = &change{Domain: d.name, From: from, To: to, Epoch: epoch, At: now}
+		}
+	}
+
+	return nil
+}
+
+// Queue Deliveries - Save a pending delivery of every change for every subscription
+func (c changes) queue(ctx context.Context, database *mongo.Database, subscriptions []subscription) error {
+
+	var documents []interface{}
+	now := time.Now().UTC()
+
+	for _, ch := range c {
+		if ch.From == ch.To {
+			continue
+		}
+		for _, s := range subscriptions {
+			documents = append(documents, delivery{
+				Subscription: s.ID,
+				Event:        *ch,
+				Status:       deliveryPending,
+				NextAttempt:  now,
+				CreatedAt:    now,
+				Log:          []attempt{},
+			})
+		}
+	}
+
+	if len(documents) == 0 {
+		return nil
+	}
+
+	_, err := database.Collection("deliveries").InsertMany(ctx, documents)
+	if err != nil {
+		return err
+	}
+	fmt.Println("* Status changes queued :", len(documents))
+
+	return nil
+}
+
+// Run Webhooks - Periodically send the pending deliveries, the subscriptions being served concurrently
+// An endpoint which doesn't answer only delays its own deliveries
+func runWebhooks(database *mongo.Database) {
+
+	var mu sync.Mutex
+	running := make(map[primitive.ObjectID]bool)
+	workers := make(chan struct{}, webhookWorkers)
+
+	for {
+		subscriptions, err := getSubscriptions(context.TODO(), database)
+		if err != nil {
+			fmt.Println("* Webhooks interrupted :", err)
+		}
+
+		for _, s := range subscriptions {
+			mu.Lock()
+			busy := running[s.ID]
+			running[s.ID] = true
+			mu.Unlock()
+			if busy {
+				continue
+			}
+
+			workers <- struct{}{}
+			go func(s subscription) {
+				defer func() {
+					mu.Lock()
+					delete(running, s.ID)
+					mu.Unlock()
+					<-workers
+				}()
+
+				if err := dispatchDeliveries(database, s.ID); err != nil {
+					fmt.Println("* Webhooks of the subscription", s.ID.Hex(), "interrupted :", err)
+				}
+			}(s)
+		}
+
+		time.Sleep(webhookInterval)
+	}
+}
+
+// Dispatch Deliveries - Send the deliveries due of a subscription, each one being leased so that it is sent once at a time
+// The dispatch stops at the first failed attempt, the endpoint being probably down, or after a batch
+func dispatchDeliveries(database *mongo.Database, subscriptionID primitive.ObjectID) error {
+
+	collection := database.Collection("deliveries")
+
+	for i := 0; i < webhookBatch; i++ {
+		now := time.Now().UTC()
+		query := bson.M{"subscription": subscriptionID, "status": deliveryPending, "nextAttempt": bson.M{"$lte": now}}
+		update := bson.M{"$set": bson.M{"nextAttempt": now.Add(webhookLease)}}
+		findOptions := options.FindOneAndUpdate().SetSort(bson.D{{Key: "nextAttempt", Value: 1}})
+
+		d := &delivery{}
+		err := collection.FindOneAndUpdate(context.TODO(), query, update, findOptions).Decode(d)
+		if err == mongo.ErrNoDocuments {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+
+		delivered, err := attemptDelivery(database, d)
+		if err != nil || !delivered {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// Attempt Delivery - Send the delivery and record the attempt, the delivery is retried later with an exponential backoff
+// Whether the endpoint accepted the delivery is returned
+func attemptDelivery(database *mongo.Database, d *delivery) (bool, error) {
+
+	s := &subscription{}
+	err := database.Collection("subscriptions").FindOne(context.TODO(), bson.M{"_id": d.Subscription}).Decode(s)
+	if err != nil && err != mongo.ErrNoDocuments {
+		return false, err
+	}
+
+	a := attempt{At: time.Now().UTC()}
+	if err == mongo.ErrNoDocuments {
+		a.Error = errSubscription.Error()
+	} else {
+		a.StatusCode, err = sendWebhook(s, d)
+		if err != nil {
+			a.Error = err.Error()
+		}
+	}
+
+	attempts := d.Attempts + 1
+	set := bson.M{"attempts": attempts}
+	delivered := a.StatusCode >= 200 && a.StatusCode < 300
+
+	switch {
+	case delivered:
+		set["status"] = deliveryDelivered
+	case attempts >= maxAttempts || a.Error == errSubscription.Error():
+		set["status"] = deliveryFailed
+	default:
+		delay := retryBase << uint(attempts-1)
+		if delay > retryMax || delay <= 0 {
+			delay = retryMax
+		}
+		set["nextAttempt"] = a.At.Add(delay)
+	}
+
+	update := bson.M{"$set": set, "$push": bson.M{"log": a}}
+	_, err = database.Collection("deliveries").UpdateOne(context.TODO(), bson.M{"_id": d.ID}, update)
+
+	return delivered, err
+}
+
+// Send Webhook - Post the change signed with the secret of the subscription
+// The signature is the HMAC-SHA256 of the timestamp, a dot and the body : X-Catchall-Signature: t=<unix>,v1=<hex>
+func sendWebhook(s *subscription, d *delivery) (int, error) {
+
+	body, err := json.Marshal(struct {
+		ID           string `json:"id"`
+		Subscription string `json:"subscription"`
+		Event        change `json:"event"`
+	}{d.ID.Hex(), s.ID.Hex(), d.Event})
+	if err != nil {
+		return 0, err
+	}
+
+	timestamp := strconv.FormatInt(time.Now().Unix(), 10)
+	mac := hmac.New(sha256.New, []byte(s.Secret))
+	mac.Write([]byte(timestamp + "."))
+	mac.Write(body)
+
+	request, err := http.NewRequest("POST", s.URL, bytes.NewReader(body))
+	if err != nil {
+		return 0, err
+	}
+	request.Header.Set("Content-Type", "application/json")
+	request.Header.Set("X-Catchall-Delivery", d.ID.Hex())
+	request.Header.Set("X-Catchall-Signature", "t="+timestamp+",v1="+hex.EncodeToString(mac.Sum(nil)))
+
+	response, err := webhookClient.Do(request)
+	if err != nil {
+		return 0, err
+	}
+	response.Body.Close()
+
+	if response.StatusCode < 200 || response.StatusCode >= 300 {
+		return response.StatusCode, fmt.Errorf("endpoint answered %s", response.Status)
+	}
+
+	return response.StatusCode, nil
+}
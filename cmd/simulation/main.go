@@ -44,7 +44,7 @@ func main() {
 			}
 		}
 		// Start Worker Web Servers
-		go exec.Command(createName("worker-api"), createArgs("127.0.0.1:1100%d 2200%d ", clIdx, clIdx)...).Run()
+		go exec.Command(createName("worker-api"), createArgs("-open 127.0.0.1:1100%d 2200%d ", clIdx, clIdx)...).Run()
 		fmt.Println("* Web worker server", clIdx, "started connected to", cluster)
 
 		clusters, cluster = clusters+cluster, ""
@@ -55,7 +55,7 @@ func main() {
 	fmt.Println("* Aggregator master service started")
 
 	// Start Master Aggregator
-	go exec.Command(createName("master-api"), createArgs("127.0.0.1:27017 8085")...).Run()
+	go exec.Command(createName("master-api"), createArgs("-open 127.0.0.1:27017 8085"+clusters)...).Run()
 	fmt.Println("* Web master server started")
 	fmt.Println("\n# READY TO RECEIVE EVENTS")
 
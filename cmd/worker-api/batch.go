@@ -0,0 +1,263 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+
+	"catchall/internal/apierror"
+	"catchall/internal/names"
+
+	"github.com/tidwall/uhatools"
+)
+
+// Limits of a batch, the statuses of its events being held until the end
+const (
+	maxBatchDomains = 1000             // domains sent in a single MINCR command
+	maxBatchEvents  = 100000           // events of a request
+	maxBatchBytes   = 16 * 1024 * 1024 // size of a request body
+)
+
+var errEventType = errors.New("unknown event type")
+var errEventCount = errors.New("invalid count, expected a positive integer")
+var errBatchTooLarge = errors.New("batch too large, expected at most 100000 events and 16MB")
+
+// Event - The count is 1 when missing
+type event struct {
+	Domain string `json:"domain"`
+	Type   string `json:"type"`
+	Count  *int64 `json:"count"`
+}
+
+// Event Status - The event is given by its line in a NDJSON stream, or its index in a JSON array
+type eventStatus struct {
+	Line   int    `json:"line,omitempty"`
+	Index  *int   `json:"index,omitempty"`
+	Status string `json:"status"`
+	Error  string `json:"error,omitempty"`
+}
+
+type eventReport struct {
+	Accepted int           `json:"accepted"`
+	Rejected int           `json:"rejected"`
+	Events   []eventStatus `json:"events"`
+}
+
+// Domain statistics coalesced from the events of a batch
+type batchDomain struct {
+	name     string
+	counters map[string]int64
+	events   []int // positions of the events in the report
+}
+
+// Post Events - Controller to ingest a batch of events sent as a JSON array or a NDJSON stream
+func postEvents(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	var domains []*batchDomain
+	index := make(map[string]*batchDomain)
+	report := &eventReport{}
+
+	body := &limitedReader{r: r.Body, left: maxBatchBytes}
+	err := readEvents(body, func(status eventStatus, e *event, err error) error {
+		if len(report.Events) == maxBatchEvents {
+			return errBatchTooLarge
+		}
+		if err == nil {
+			err = e.validate()
+		}
+		if err != nil {
+			status.Status, status.Error = "error", err.Error()
+			report.Events = append(report.Events, status)
+			return nil
+		}
+
+		d, existed := index[e.Domain]
+		if !existed {
+			d = &batchDomain{name: e.Domain, counters: make(map[string]int64)}
+			index[e.Domain] = d
+			domains = append(domains, d)
+		}
+		d.counters[e.Type] += *e.Count
+		d.events = append(d.events, len(report.Events))
+
+		status.Status = "ok"
+		report.Events = append(report.Events, status)
+		return nil
+	})
+	if err == errBatchTooLarge {
+		apierror.Write(w, r, 413, err.Error())
+		return
+	}
+	if err != nil {
+		apierror.Invalid(w, r, err)
+		return
+	}
+
+	for start := 0; start < len(domains); start += maxBatchDomains {
+		end := start + maxBatchDomains
+		if end > len(domains) {
+			end = len(domains)
+		}
+		if err := incrementDomains(domains[start:end]); err != nil {
+			for _, d := range domains[start:end] {
+				for _, idx := range d.events {
+					report.Events[idx].Status = "error"
+					report.Events[idx].Error = err.Error()
+				}
+			}
+		}
+	}
+
+	for _, status := range report.Events {
+		if status.Status == "ok" {
+			report.Accepted++
+		} else {
+			report.Rejected++
+		}
+	}
+
+	json.NewEncoder(w).Encode(report)
+}
+
+// Read Events - Decode the events one by one from a JSON array or a NDJSON stream
+// A malformed JSON array stops the reading, a malformed NDJSON line is reported on its own
+// An error returned by the handler stops the reading
+func readEvents(body io.Reader, handle func(status eventStatus, e *event, err error) error) error {
+
+	rd := bufio.NewReader(body)
+	first := 1
+
+	for {
+		c, err := rd.ReadByte()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if c == '\n' {
+			first++
+		}
+		if c == ' ' || c == '\t' || c == '\r' || c == '\n' {
+			continue
+		}
+		rd.UnreadByte()
+		if c == '[' {
+			return readEventsArray(rd, handle)
+		}
+		return readEventsLines(rd, first, handle)
+	}
+}
+
+func readEventsArray(rd io.Reader, handle func(status eventStatus, e *event, err error) error) error {
+
+	decoder := json.NewDecoder(rd)
+	if _, err := decoder.Token(); err != nil {
+		return err
+	}
+
+	for index := 0; decoder.More(); index++ {
+		e := &event{}
+		if err := decoder.Decode(e); err != nil {
+			return err
+		}
+		i := index
+		if err := handle(eventStatus{Index: &i}, e, nil); err != nil {
+			return err
+		}
+	}
+
+	_, err := decoder.Token()
+
+	return err
+}
+
+func readEventsLines(rd io.Reader, first int, handle func(status eventStatus, e *event, err error) error) error {
+
+	scanner := bufio.NewScanner(rd)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+
+	for line := first; scanner.Scan(); line++ {
+		if len(bytes.TrimSpace(scanner.Bytes())) == 0 {
+			continue
+		}
+		e := &event{}
+		err := json.Unmarshal(scanner.Bytes(), e)
+		if err != nil {
+			e = nil
+		}
+		if err := handle(eventStatus{Line: line}, e, err); err != nil {
+			return err
+		}
+	}
+
+	return scanner.Err()
+}
+
+// Validate - Check the event, canonicalize its domain and count it once when no count is given
+// An explicit count must be positive
+func (e *event) validate() error {
+	name, err := names.Canonical(e.Domain)
+	if err != nil {
+		return err
+	}
+	e.Domain = name
+	if !eventTypes[e.Type] {
+		return errEventType
+	}
+	if e.Count == nil {
+		one := int64(1)
+		e.Count = &one
+	}
+	if *e.Count <= 0 {
+		return errEventCount
+	}
+	return nil
+}
+
+// Limited Reader - Body failing with errBatchTooLarge once its limit is exceeded
+type limitedReader struct {
+	r    io.Reader
+	left int64
+}
+
+func (l *limitedReader) Read(p []byte) (int, error) {
+
+	if l.left <= 0 {
+		// Whether the body is over the limit or just ends at it
+		var b [1]byte
+		if n, err := l.r.Read(b[:]); n == 0 {
+			return 0, err
+		}
+		return 0, errBatchTooLarge
+	}
+	if int64(len(p)) > l.left {
+		p = p[:l.left]
+	}
+	n, err := l.r.Read(p)
+	l.left -= int64(n)
+
+	return n, err
+}
+
+// Increment Domains - Send the coalesced counters to the cluster in a single command
+func incrementDomains(domains []*batchDomain) error {
+
+	var args []interface{}
+	for _, d := range domains {
+		for t, count := range d.counters {
+			args = append(args, d.name, t, count)
+		}
+	}
+
+	conn := cl.Get()
+	defer conn.Close()
+
+	_, err := uhatools.Values(conn.Do("MINCR", args...))
+
+	return err
+}
@@ -1,11 +1,21 @@
 package main
 
 import (
+	"encoding/json"
+	"flag"
 	"fmt"
 	"log"
 	"net/http"
 	"os"
+	"strconv"
 	"strings"
+	"time"
+
+	"catchall/internal/apierror"
+	"catchall/internal/events"
+	"catchall/internal/keys"
+	"catchall/internal/names"
+	"catchall/internal/storage"
 
 	"github.com/gorilla/mux"
 	"github.com/tidwall/uhatools"
@@ -13,24 +23,77 @@ import (
 
 var cl *uhatools.Cluster
 
+// API keys required by the routes, nil with the open access
+var apiKeys *keys.Store
+
+// Event types accepted by the web server
+var eventTypes = make(map[string]bool)
+
+type epochCounters struct {
+	Epoch    string           `json:"epoch"`
+	Start    time.Time        `json:"start"`
+	Counters map[string]int64 `json:"counters"`
+}
+
+type domainCounters struct {
+	Domain string           `json:"domain"`
+	Epochs []epochCounters  `json:"epochs"`
+	Total  map[string]int64 `json:"total"`
+}
+
 func main() {
 
 	var err error
-	if len(os.Args) < 3 {
+	types := flag.String("types", "delivered,bounced", "comma separated list of the accepted event types")
+	keysAddress := flag.String("keys", "", "address of the master database holding the API keys required by the routes")
+	open := flag.Bool("open", false, "serve the routes to anyone without API key")
+	flag.Parse()
+
+	args := flag.Args()
+	if len(args) < 2 {
 		fmt.Fprintf(os.Stderr, "Specify the address of database cluster servers")
 		os.Exit(1)
 	}
+	if (len(*keysAddress) > 0) == *open {
+		fmt.Fprintf(os.Stderr, "Specify either the address of the API keys database with -keys or the open access with -open")
+		os.Exit(1)
+	}
+
+	for _, t := range strings.Split(*types, ",") {
+		if !events.ValidType(t) {
+			fmt.Fprintf(os.Stderr, "Invalid event type '%s'", t)
+			os.Exit(1)
+		}
+		eventTypes[t] = true
+	}
 
 	fmt.Println("\n# Starting 'CatchAll - Worker Web Server' application")
-	fmt.Println("* Application try connection to the database cluster", os.Args[1])
 
-	if cl, err = connectDBCluster(strings.Split(os.Args[1], ",")); err != nil {
+	if *open {
+		fmt.Println("* WARNING : Application serves the routes to anyone, no API key is required")
+	} else {
+		fmt.Println("* Application try connection to the API keys database", *keysAddress)
+
+		keysStore, err := storage.OpenMongo(*keysAddress)
+		if err != nil {
+			fmt.Println("* Failed to open the API keys database :", err)
+			return
+		}
+		defer keysStore.Close()
+		fmt.Println("* Connected to the master DB")
+
+		apiKeys = keys.NewStore(storage.Database(keysStore).Collection("keys"))
+	}
+
+	fmt.Println("* Application try connection to the database cluster", args[0])
+
+	if cl, err = connectDBCluster(strings.Split(args[0], ",")); err != nil {
 		return
 	}
 	defer cl.Close()
 
-	fmt.Println("* Application starts the web server on port", os.Args[2])
-	startWebServer(os.Args[2])
+	fmt.Println("* Application starts the web server on port", args[1])
+	startWebServer(args[1])
 }
 
 // Connect DB Cluster - Connect the master to an in-memory fault tolerant worker database
@@ -68,33 +131,97 @@ func pingDBCluster(cl *uhatools.Cluster) error {
 func startWebServer(port string) {
 
 	router := mux.NewRouter().StrictSlash(true)
+	router.Use(apierror.RequestID)
+	router.NotFoundHandler = apierror.RequestID(http.HandlerFunc(apierror.NotFound))
+	router.MethodNotAllowedHandler = apierror.RequestID(http.HandlerFunc(apierror.MethodNotAllowed))
 
-	router.HandleFunc("/events/{domain}/delivered", incrementDelivered).Methods("PUT")
-	router.HandleFunc("/events/{domain}/bounced", incrementBounced).Methods("PUT")
+	read := apiKeys.Require(keys.DomainsRead)
+	write := apiKeys.Require(keys.EventsWrite)
+
+	router.Handle("/events/{domain}", read(http.HandlerFunc(getDomain))).Methods("GET")
+	router.Handle("/events/{domain}/{type}", write(http.HandlerFunc(incrementEvent))).Methods("PUT")
+	router.Handle("/events", write(http.HandlerFunc(postEvents))).Methods("POST")
 
 	log.Fatal(http.ListenAndServe(":"+port, router))
 }
 
-func incrementDelivered(w http.ResponseWriter, r *http.Request) {
+// Increment Event - Controller to count an event of one of the accepted types
+func incrementEvent(w http.ResponseWriter, r *http.Request) {
 	var params = mux.Vars(r)
 
+	name, err := names.Canonical(params["domain"])
+	if err != nil {
+		apierror.Invalid(w, r, err)
+		return
+	}
+	if !eventTypes[params["type"]] {
+		apierror.Invalid(w, r, errEventType)
+		return
+	}
+
 	conn := cl.Get()
 	defer conn.Close()
 
-	_, err := uhatools.String(conn.Do("INCR", params["domain"], "1", "0"))
+	_, err = uhatools.String(conn.Do("INCR", name, params["type"], "1"))
 	if err != nil {
-		w.WriteHeader(500)
+		apierror.Backend(w, r, err)
 	}
 }
 
-func incrementBounced(w http.ResponseWriter, r *http.Request) {
+// Get Domain - Controller to get the statistics of a domain still held by the cluster
+func getDomain(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
 	var params = mux.Vars(r)
 
+	name, err := names.Canonical(params["domain"])
+	if err != nil {
+		apierror.Invalid(w, r, err)
+		return
+	}
+
 	conn := cl.Get()
 	defer conn.Close()
 
-	_, err := uhatools.String(conn.Do("INCR", params["domain"], "0", "1"))
+	info, err := uhatools.String(conn.Do("DBINFO"))
 	if err != nil {
-		w.WriteHeader(500)
+		apierror.Backend(w, r, err)
+		return
+	}
+	resp, err := uhatools.Strings(conn.Do("GET", name))
+	if err != nil {
+		apierror.Backend(w, r, err)
+		return
 	}
+
+	// The epochs are numbered in base 32 from the unix time divided by the epoch length
+	var length int64 = 30
+	if fields := strings.Split(info, " "); len(fields) > 2 {
+		length, _ = strconv.ParseInt(fields[2], 10, 64)
+	}
+
+	d := &domainCounters{Domain: name, Epochs: []epochCounters{}}
+
+	// Each entry is the epoch, or total, its number of counters and the type and count pairs
+	for n := 0; n+1 < len(resp); {
+
+		name := resp[n]
+		count, _ := strconv.Atoi(resp[n+1])
+		counters := make(map[string]int64)
+		n += 2
+
+		for i := 0; i < count && n+1 < len(resp); i, n = i+1, n+2 {
+			counters[resp[n]], _ = strconv.ParseInt(resp[n+1], 10, 64)
+		}
+
+		if name == "total" {
+			d.Total = counters
+			continue
+		}
+
+		epoch, _ := strconv.ParseInt(name, 32, 64)
+		d.Epochs = append(d.Epochs, epochCounters{name, time.Unix(epoch*length, 0).UTC(), counters})
+	}
+
+	json.NewEncoder(w).Encode(d)
 }
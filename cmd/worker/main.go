@@ -1,11 +1,17 @@
 package main
 
 import (
+	"bufio"
+	"errors"
 	"fmt"
 	"io"
+	"sort"
 	"strconv"
+	"strings"
 	"time"
 
+	"catchall/internal/events"
+
 	"github.com/tidwall/sds"
 	"github.com/tidwall/tinybtree"
 	"github.com/tidwall/uhaha"
@@ -16,32 +22,46 @@ func main() {
 
 	conf.Name = "catchall"
 	conf.Version = "0.0.1"
-	conf.InitialData = new(database)
+	conf.InitialData = &database{length: defaultEpochLength}
 	conf.Snapshot = snapshot
 	conf.Restore = restore
 
 	conf.AddWriteCommand("incr", cmdINCR)
+	conf.AddWriteCommand("mincr", cmdMINCR)
 	conf.AddWriteCommand("extract", cmdEXTRACT)
+	conf.AddWriteCommand("epochlen", cmdEPOCHLEN)
+	conf.AddWriteCommand("retention", cmdRETENTION)
+	conf.AddWriteCommand("tick", cmdTICK)
 	conf.AddReadCommand("scan", cmdSCAN)
+	conf.AddReadCommand("get", cmdGET)
 	conf.AddReadCommand("dbinfo", cmdDBINFO)
 
 	uhaha.Main(conf)
 }
 
 type domain struct {
-	name      string
-	delivered int64
-	bounced   int64
+	name     string
+	counters map[string]int64
 }
 
 type database struct {
-	current   string
-	retrieved string
-	periods   tinybtree.BTree
+	current    string
+	retrieved  string
+	length     int64
+	maxEpochs  int64 // retention policy, zero is unlimited
+	maxDomains int64 // retention policy, zero is unlimited
+	size       int64 // number of domains held in all the periods
+	evictions  int64 // number of periods evicted by the retention policy
+	periods    tinybtree.BTree
 }
 
-func getEpoch(now time.Time) string {
-	return strconv.FormatInt(now.Unix()/30, 32)
+// Length of the epochs in seconds when not configured
+const defaultEpochLength = 30
+
+var errEpochLength = errors.New("epoch length can only be changed before the first increment")
+
+func (db *database) getEpoch(now time.Time) string {
+	return strconv.FormatInt(now.Unix()/db.length, 32)
 }
 
 func nextEpoch(current string) string {
@@ -73,43 +93,180 @@ func (db *database) getPeriod(epoch string, create bool) *tinybtree.BTree {
 	return period
 }
 
-// INCR domain delivered bounced
-// Increment the domain statistics for the current epoch
+// Restore Period
+// Create a period of a snapshot if doesn't exist, the current epoch restored being kept
+// The current epoch can be after the last period once moved by TICK
+func (db *database) restorePeriod(epoch string) *tinybtree.BTree {
+	v, _ := db.periods.Get(epoch)
+	if v != nil {
+		return v.(*tinybtree.BTree)
+	}
+	period := &tinybtree.BTree{}
+	db.periods.Set(epoch, period)
+	return period
+}
+
+// Delete Period
+// Delete a period and forget its domains
+func (db *database) deletePeriod(epoch string) {
+	v, deleted := db.periods.Delete(epoch)
+	if deleted {
+		db.size -= int64(v.(*tinybtree.BTree).Len())
+	}
+}
+
+// Evict
+// Delete the oldest periods until the retention policy is satisfied, the current period is always kept
+func (db *database) evict() {
+	for db.periods.Len() > 1 {
+		if (db.maxEpochs == 0 || int64(db.periods.Len()) <= db.maxEpochs) &&
+			(db.maxDomains == 0 || db.size <= db.maxDomains) {
+			return
+		}
+		var oldest string
+		db.periods.Scan(func(epoch string, v interface{}) bool {
+			oldest = epoch
+			return false
+		})
+		db.deletePeriod(oldest)
+		db.evictions++
+	}
+}
+
+// INCR domain type count [type count ...]
+// Increment the domain counters for the current epoch
+// The former form INCR domain delivered bounced is still accepted to apply the existing logs
 func cmdINCR(m uhaha.Machine, args []string) (interface{}, error) {
 	data := m.Data().(*database)
-	if len(args) < 4 {
+	if len(args) < 4 || len(args)%2 != 0 {
 		return nil, uhaha.ErrWrongNumArgs
 	}
 
-	var d *domain
-
-	epoch := getEpoch(m.Now())
+	epoch := data.getEpoch(m.Now())
 	name := string(args[1])
-	delivered, _ := strconv.ParseInt(args[2], 10, 64)
-	bounced, _ := strconv.ParseInt(args[3], 10, 64)
+	counters, err := parseCounters(args[2:])
+	if err != nil {
+		return nil, err
+	}
 
 	p := data.getPeriod(epoch, true)
 
+	data.incrDomain(p, name, counters)
+	data.evict()
+
+	return "OK", nil
+}
+
+// MINCR domain type count [domain type count ...]
+// Increment the counters of several domains for the current epoch at once
+// Nothing is applied if an item is invalid, the period counters of each item are returned
+// The former items domain delivered bounced are still accepted to apply the existing logs
+func cmdMINCR(m uhaha.Machine, args []string) (interface{}, error) {
+	data := m.Data().(*database)
+	if len(args) < 4 || (len(args)-1)%3 != 0 {
+		return nil, uhaha.ErrWrongNumArgs
+	}
+
+	n := (len(args) - 1) / 3
+	counters := make([]map[string]int64, n)
+
+	for i := 0; i < n; i++ {
+		var err error
+		if counters[i], err = parseCounters(args[3*i+2 : 3*i+4]); err != nil {
+			return nil, err
+		}
+	}
+
+	epoch := data.getEpoch(m.Now())
+	p := data.getPeriod(epoch, true)
+	results := make([]interface{}, n)
+
+	for i := 0; i < n; i++ {
+		d := data.incrDomain(p, args[3*i+1], counters[i])
+		result := make(map[string]int64, len(d.counters))
+		for t, count := range d.counters {
+			result[t] = count
+		}
+		results[i] = result
+	}
+	data.evict()
+
+	return results, nil
+}
+
+// Parse the type and count pairs of an increment
+// A single pair of numbers is the former delivered and bounced form
+func parseCounters(args []string) (map[string]int64, error) {
+	counters := make(map[string]int64)
+
+	if delivered, err := strconv.ParseInt(args[0], 10, 64); err == nil && len(args) == 2 {
+		bounced, err := strconv.ParseInt(args[1], 10, 64)
+		if err != nil {
+			return nil, uhaha.ErrInvalid
+		}
+		counters["delivered"] = delivered
+		counters["bounced"] = bounced
+		return counters, nil
+	}
+
+	for i := 0; i < len(args); i += 2 {
+		if !events.ValidType(args[i]) {
+			return nil, uhaha.ErrInvalid
+		}
+		count, err := strconv.ParseInt(args[i+1], 10, 64)
+		if err != nil {
+			return nil, uhaha.ErrInvalid
+		}
+		counters[args[i]] += count
+	}
+
+	return counters, nil
+}
+
+// Increment the domain counters in a period
+// Create the domain if doesn't exist and return the domain
+func (db *database) incrDomain(p *tinybtree.BTree, name string, counters map[string]int64) *domain {
+	var d *domain
+
 	v, existed := p.Get(name)
 
 	if !existed {
 		d = new(domain)
 		d.name = name
-		d.delivered = 0
-		d.bounced = 0
+		d.counters = make(map[string]int64)
+		db.size++
 	} else {
 		d = v.(*domain)
 	}
 
-	d.delivered += delivered
-	d.bounced += bounced
+	for t, count := range counters {
+		if count != 0 {
+			d.counters[t] += count
+		}
+	}
 	p.Set(d.name, d)
 
-	return "OK", nil
+	return d
+}
+
+// Append the domain as its name, its number of counters and the type and count pairs
+func appendDomain(arr []string, d *domain) []string {
+	types := make([]string, 0, len(d.counters))
+	for t := range d.counters {
+		types = append(types, t)
+	}
+	sort.Strings(types)
+
+	arr = append(arr, d.name, strconv.Itoa(len(types)))
+	for _, t := range types {
+		arr = append(arr, t, strconv.FormatInt(d.counters[t], 10))
+	}
+	return arr
 }
 
-// EXTRACT epoch
+// EXTRACT epoch [CURSOR cursor] [COUNT count]
 // Extract the domain statistics and delete the previous period statistics
+// The last retrieved epoch can be extracted again until the next one is, which allows to extract it by pages
 func cmdEXTRACT(m uhaha.Machine, args []string) (interface{}, error) {
 	data := m.Data().(*database)
 	if len(args) < 2 {
@@ -117,32 +274,161 @@ func cmdEXTRACT(m uhaha.Machine, args []string) (interface{}, error) {
 	}
 
 	epoch := string(args[1])
+	paged, cursor, count, err := parsePaging(args[2:])
+	if err != nil {
+		return nil, err
+	}
 
-	if epoch == data.current && epoch != nextEpoch(data.retrieved) {
+	if epoch == data.current && epoch != nextEpoch(data.retrieved) && epoch != data.retrieved {
 		return nil, uhaha.ErrInvalid
 	}
 
 	p := data.getPeriod(epoch, false)
 	arr := []string{}
 
-	if p != nil {
+	if paged {
+		arr = scanPage(p, cursor, count)
+	} else if p != nil {
 		p.Scan(func(name string, v interface{}) bool {
-			d := v.(*domain)
-			arr = append(arr, d.name)
-			arr = append(arr, fmt.Sprint(d.delivered))
-			arr = append(arr, fmt.Sprint(d.bounced))
+			arr = appendDomain(arr, v.(*domain))
 			return true
 		})
 	}
 
-	data.periods.Delete(previousEpoch(epoch))
+	data.deletePeriod(previousEpoch(epoch))
 	data.retrieved = epoch
 
 	return arr, nil
 }
 
-// SCAN epoch
+// Default number of domains returned in a page
+const defaultPageSize = 1000
+
+// Parse the optional CURSOR and COUNT arguments of the paginated commands
+func parsePaging(args []string) (paged bool, cursor string, count int, err error) {
+	count = defaultPageSize
+	if len(args)%2 != 0 {
+		return false, "", 0, uhaha.ErrSyntax
+	}
+	for i := 0; i < len(args); i += 2 {
+		switch strings.ToLower(args[i]) {
+		case "cursor":
+			cursor = args[i+1]
+		case "count":
+			count, err = strconv.Atoi(args[i+1])
+			if err != nil || count <= 0 {
+				return false, "", 0, uhaha.ErrInvalid
+			}
+		default:
+			return false, "", 0, uhaha.ErrSyntax
+		}
+		paged = true
+	}
+	return paged, cursor, count, nil
+}
+
+// Scan Page
+// Return the next cursor followed by the domains after the cursor
+// The next cursor is the last domain returned, it is empty once the period is complete
+func scanPage(p *tinybtree.BTree, cursor string, count int) []string {
+	arr := []string{""}
+	if p == nil {
+		return arr
+	}
+
+	var n int
+	var last string
+
+	p.Ascend(cursor, func(name string, v interface{}) bool {
+		if len(cursor) != 0 && name == cursor {
+			return true
+		}
+		if n == count {
+			arr[0] = last
+			return false
+		}
+		arr = appendDomain(arr, v.(*domain))
+		last = name
+		n++
+		return true
+	})
+
+	return arr
+}
+
+// EPOCHLEN seconds
+// Set the length of the epochs, only allowed before the first increment
+func cmdEPOCHLEN(m uhaha.Machine, args []string) (interface{}, error) {
+	data := m.Data().(*database)
+	if len(args) < 2 {
+		return nil, uhaha.ErrWrongNumArgs
+	}
+
+	length, err := strconv.ParseInt(args[1], 10, 64)
+	if err != nil || length <= 0 {
+		return nil, uhaha.ErrInvalid
+	}
+
+	if len(data.current) != 0 {
+		return nil, errEpochLength
+	}
+
+	data.length = length
+
+	return "OK", nil
+}
+
+// RETENTION epochs domains
+// Set the maximum number of epochs and domains held, zero is unlimited
+// The oldest periods are evicted on the next increments when one of them is exceeded
+func cmdRETENTION(m uhaha.Machine, args []string) (interface{}, error) {
+	data := m.Data().(*database)
+	if len(args) < 3 {
+		return nil, uhaha.ErrWrongNumArgs
+	}
+
+	maxEpochs, err := strconv.ParseInt(args[1], 10, 64)
+	if err != nil || maxEpochs < 0 {
+		return nil, uhaha.ErrInvalid
+	}
+	maxDomains, err := strconv.ParseInt(args[2], 10, 64)
+	if err != nil || maxDomains < 0 {
+		return nil, uhaha.ErrInvalid
+	}
+
+	data.maxEpochs = maxEpochs
+	data.maxDomains = maxDomains
+	data.evict()
+
+	return "OK", nil
+}
+
+// TICK
+// Move the current epoch to the one of the leader clock, closing the previous epochs without increment
+// Nothing is done before the first increment, the current epoch is returned
+func cmdTICK(m uhaha.Machine, args []string) (interface{}, error) {
+	data := m.Data().(*database)
+	if len(args) != 1 {
+		return nil, uhaha.ErrWrongNumArgs
+	}
+
+	if len(data.current) == 0 {
+		return nil, nil
+	}
+
+	epoch := data.getEpoch(m.Now())
+	next, _ := strconv.ParseInt(epoch, 32, 64)
+	current, _ := strconv.ParseInt(data.current, 32, 64)
+	if next > current {
+		data.current = epoch
+	}
+
+	return data.current, nil
+}
+
+// SCAN epoch [CURSOR cursor] [COUNT count]
 // Retrieve the domain statistics for a specific period
+// The domains are returned by pages after the next cursor when CURSOR or COUNT is given
 func cmdSCAN(m uhaha.Machine, args []string) (interface{}, error) {
 	data := m.Data().(*database)
 	if len(args) < 2 {
@@ -150,16 +436,19 @@ func cmdSCAN(m uhaha.Machine, args []string) (interface{}, error) {
 	}
 
 	epoch := string(args[1])
+	paged, cursor, count, err := parsePaging(args[2:])
+	if err != nil {
+		return nil, err
+	}
 
 	p := data.getPeriod(epoch, false)
 	arr := []string{}
 
-	if p != nil {
+	if paged {
+		arr = scanPage(p, cursor, count)
+	} else if p != nil {
 		p.Scan(func(name string, v interface{}) bool {
-			d := v.(*domain)
-			arr = append(arr, d.name)
-			arr = append(arr, fmt.Sprint(d.delivered))
-			arr = append(arr, fmt.Sprint(d.bounced))
+			arr = appendDomain(arr, v.(*domain))
 			return true
 		})
 	}
@@ -167,42 +456,130 @@ func cmdSCAN(m uhaha.Machine, args []string) (interface{}, error) {
 	return arr, nil
 }
 
+// GET domain
+// Retrieve the domain statistics of every period held followed by the total
+// Each entry is the epoch, or total, its number of counters and the type and count pairs
+func cmdGET(m uhaha.Machine, args []string) (interface{}, error) {
+	data := m.Data().(*database)
+	if len(args) < 2 {
+		return nil, uhaha.ErrWrongNumArgs
+	}
+
+	name := string(args[1])
+	total := &domain{name: "total", counters: make(map[string]int64)}
+	arr := []string{}
+
+	data.periods.Scan(func(epoch string, v interface{}) bool {
+		if v, existed := v.(*tinybtree.BTree).Get(name); existed {
+			d := v.(*domain)
+			arr = appendDomain(arr, &domain{name: epoch, counters: d.counters})
+			for t, count := range d.counters {
+				total.counters[t] += count
+			}
+		}
+		return true
+	})
+
+	return appendDomain(arr, total), nil
+}
+
 // DBINFO
-// Retrieve the database information
+// Retrieve the database information [current] [retrieved] [epoch length] [evictions]
 func cmdDBINFO(m uhaha.Machine, args []string) (interface{}, error) {
 	data := m.Data().(*database)
 	if len(args) < 1 {
 		return nil, uhaha.ErrWrongNumArgs
 	}
+	info := strconv.FormatInt(data.length, 10) + " " + strconv.FormatInt(data.evictions, 10)
 	if len(data.current) == 0 {
-		return "<nil> <nil>", nil
+		return "<nil> <nil> " + info, nil
 	}
-	return data.current + " " + data.retrieved, nil
+	return data.current + " " + data.retrieved + " " + info, nil
 }
 
 // #region -- SNAPSHOT & RESTORE
 
+// Snapshots start with the format identifier followed by the format version
+// The snapshots written before have no header and hold the delivered and bounced counters in the domain records,
+// the other counters following the epoch length
+const snapMagic = "CATCHALL"
+const snapVersion = 2
+
+var errSnapTruncated = errors.New("snapshot is truncated")
+
+// Longest string and largest number of counters of a domain accepted in a snapshot
+// A corrupt length fails the restore instead of allocating it
+const snapMaxString = 1 << 16
+const snapMaxCounters = 1 << 16
+
+// Snap Reader - Reader of the snapshots bounding the lengths read
+type snapReader struct {
+	*sds.Reader
+	br *bufio.Reader
+}
+
+// The sds reader shares the buffered reader given
+func newSnapReader(br *bufio.Reader) *snapReader {
+	return &snapReader{sds.NewReader(br), br}
+}
+
+func (r *snapReader) ReadString() (string, error) {
+	n, err := r.ReadUvarint()
+	if err != nil {
+		return "", err
+	}
+	if n > snapMaxString {
+		return "", uhaha.ErrCorrupt
+	}
+	b := make([]byte, n)
+	if _, err := io.ReadFull(r.br, b); err != nil {
+		return "", err
+	}
+	return string(b), nil
+}
+
 type snapDomain struct {
-	epoch     string
-	name      string
-	delivered int64
-	bounced   int64
+	epoch    string
+	name     string
+	counters map[string]int64
 }
 
 type dbSnapshot struct {
-	current   string
-	retrieved string
-	domains   []snapDomain
+	current    string
+	retrieved  string
+	length     int64
+	maxEpochs  int64
+	maxDomains int64
+	evictions  int64
+	domains    []snapDomain
 }
 
 func (s *dbSnapshot) Persist(wr io.Writer) error {
+	if _, err := io.WriteString(wr, snapMagic); err != nil {
+		return err
+	}
 	w := sds.NewWriter(wr)
+	if err := w.WriteUvarint(snapVersion); err != nil {
+		return err
+	}
 	if err := w.WriteString(s.current); err != nil {
 		return err
 	}
 	if err := w.WriteString(s.retrieved); err != nil {
 		return err
 	}
+	if err := w.WriteInt64(s.length); err != nil {
+		return err
+	}
+	if err := w.WriteInt64(s.maxEpochs); err != nil {
+		return err
+	}
+	if err := w.WriteInt64(s.maxDomains); err != nil {
+		return err
+	}
+	if err := w.WriteInt64(s.evictions); err != nil {
+		return err
+	}
 	if err := w.WriteUvarint(uint64(len(s.domains))); err != nil {
 		return err
 	}
@@ -213,11 +590,16 @@ func (s *dbSnapshot) Persist(wr io.Writer) error {
 		if err := w.WriteString(d.name); err != nil {
 			return err
 		}
-		if err := w.WriteInt64(d.delivered); err != nil {
+		if err := w.WriteUvarint(uint64(len(d.counters))); err != nil {
 			return err
 		}
-		if err := w.WriteInt64(d.bounced); err != nil {
-			return err
+		for t, count := range d.counters {
+			if err := w.WriteString(t); err != nil {
+				return err
+			}
+			if err := w.WriteInt64(count); err != nil {
+				return err
+			}
 		}
 	}
 	return w.Flush()
@@ -234,11 +616,19 @@ func snapshot(data interface{}) (uhaha.Snapshot, error) {
 	snap := new(dbSnapshot)
 	snap.current = db.current
 	snap.retrieved = db.retrieved
+	snap.length = db.length
+	snap.maxEpochs = db.maxEpochs
+	snap.maxDomains = db.maxDomains
+	snap.evictions = db.evictions
 	db.periods.Scan(func(epoch string, v interface{}) bool {
 		period := v.(*tinybtree.BTree)
 		period.Scan(func(name string, v interface{}) bool {
 			d := v.(*domain)
-			snap.domains = append(snap.domains, snapDomain{epoch, name, d.delivered, d.bounced})
+			counters := make(map[string]int64, len(d.counters))
+			for t, count := range d.counters {
+				counters[t] = count
+			}
+			snap.domains = append(snap.domains, snapDomain{epoch, name, counters})
 			return true
 		})
 		return true
@@ -246,27 +636,120 @@ func snapshot(data interface{}) (uhaha.Snapshot, error) {
 	return snap, nil
 }
 
-func snapDomainObject(r *sds.Reader) (*domain, error) {
+func snapDomainObject(r *snapReader) (*domain, error) {
 	d := new(domain)
 	var err error
 	d.name, err = r.ReadString()
 	if err != nil {
 		return nil, err
 	}
-	d.delivered, err = r.ReadInt64()
+	n, err := r.ReadUvarint()
 	if err != nil {
 		return nil, err
 	}
-	d.bounced, err = r.ReadInt64()
+	if n > snapMaxCounters {
+		return nil, uhaha.ErrCorrupt
+	}
+	d.counters = make(map[string]int64, n)
+	for i := uint64(0); i < n; i++ {
+		t, err := r.ReadString()
+		if err != nil {
+			return nil, err
+		}
+		d.counters[t], err = r.ReadInt64()
+		if err != nil {
+			return nil, err
+		}
+	}
+	return d, nil
+}
+
+func snapLegacyDomainObject(r *snapReader) (*domain, error) {
+	d := new(domain)
+	var err error
+	d.name, err = r.ReadString()
+	if err != nil {
+		return nil, err
+	}
+	delivered, err := r.ReadInt64()
 	if err != nil {
 		return nil, err
 	}
+	bounced, err := r.ReadInt64()
+	if err != nil {
+		return nil, err
+	}
+	d.counters = make(map[string]int64)
+	if delivered != 0 {
+		d.counters["delivered"] = delivered
+	}
+	if bounced != 0 {
+		d.counters["bounced"] = bounced
+	}
 	return d, nil
 }
 
 func restore(rd io.Reader) (interface{}, error) {
+	br := bufio.NewReader(rd)
+	var db *database
+	var err error
+	if magic, _ := br.Peek(len(snapMagic)); string(magic) != snapMagic {
+		db, err = restoreLegacy(newSnapReader(br))
+	} else {
+		br.Discard(len(snapMagic))
+		r := newSnapReader(br)
+		var version uint64
+		if version, err = r.ReadUvarint(); err == nil {
+			switch version {
+			case 1:
+				db, err = restoreV1(r)
+			case 2:
+				db, err = restoreV2(r)
+			default:
+				return nil, fmt.Errorf("unsupported snapshot version %d", version)
+			}
+		}
+	}
+	if err == io.EOF || err == io.ErrUnexpectedEOF {
+		return nil, errSnapTruncated
+	}
+	if err != nil {
+		return nil, fmt.Errorf("invalid snapshot: %w", err)
+	}
+	return db, nil
+}
+
+// Version 1 has no retention policy
+func restoreV1(r *snapReader) (*database, error) {
+	db, err := restoreHeader(r)
+	if err != nil {
+		return nil, err
+	}
+	return db, restorePeriods(r, db, snapDomainObject)
+}
+
+func restoreV2(r *snapReader) (*database, error) {
+	db, err := restoreHeader(r)
+	if err != nil {
+		return nil, err
+	}
+	if db.maxEpochs, err = r.ReadInt64(); err != nil {
+		return nil, err
+	}
+	if db.maxDomains, err = r.ReadInt64(); err != nil {
+		return nil, err
+	}
+	if db.evictions, err = r.ReadInt64(); err != nil {
+		return nil, err
+	}
+	if db.maxEpochs < 0 || db.maxDomains < 0 {
+		return nil, uhaha.ErrCorrupt
+	}
+	return db, restorePeriods(r, db, snapDomainObject)
+}
+
+func restoreHeader(r *snapReader) (*database, error) {
 	db := new(database)
-	r := sds.NewReader(rd)
 	var err error
 	if db.current, err = r.ReadString(); err != nil {
 		return nil, err
@@ -274,28 +757,114 @@ func restore(rd io.Reader) (interface{}, error) {
 	if db.retrieved, err = r.ReadString(); err != nil {
 		return nil, err
 	}
+	if db.length, err = r.ReadInt64(); err != nil {
+		return nil, err
+	}
+	if db.length <= 0 {
+		return nil, uhaha.ErrCorrupt
+	}
+	return db, nil
+}
+
+func restorePeriods(r *snapReader, db *database, object func(r *snapReader) (*domain, error)) error {
 	n, err := r.ReadUvarint()
 	if err != nil {
-		return nil, err
+		return err
 	}
 	var period *tinybtree.BTree
 	var lastEpoch string
 	for i := uint64(0); i < n; i++ {
 		epoch, err := r.ReadString()
 		if err != nil {
-			return nil, err
+			return err
 		}
-		d, err := snapDomainObject(r)
+		d, err := object(r)
 		if err != nil {
-			return nil, err
+			return err
 		}
 		if epoch != lastEpoch {
-			period = db.getPeriod(epoch, true)
+			period = db.restorePeriod(epoch)
 			lastEpoch = epoch
 		}
 		period.Set(d.name, d)
+		db.size++
+	}
+	return nil
+}
+
+// The epoch length and then the other counters were optionally written at the end of the legacy snapshots
+func restoreLegacy(r *snapReader) (*database, error) {
+	db := new(database)
+	var err error
+	if db.current, err = r.ReadString(); err != nil {
+		return nil, err
+	}
+	if db.retrieved, err = r.ReadString(); err != nil {
+		return nil, err
+	}
+	if err = restorePeriods(r, db, snapLegacyDomainObject); err != nil {
+		return nil, err
+	}
+	if db.length, err = r.ReadInt64(); err == io.EOF {
+		db.length = defaultEpochLength
+		return db, nil
+	} else if err != nil {
+		return nil, err
+	}
+	if db.length <= 0 {
+		return nil, uhaha.ErrCorrupt
+	}
+	if err = restoreLegacyCounters(db, r); err != nil {
+		return nil, err
 	}
 	return db, nil
 }
 
+// Restore Legacy Counters - Add the other counters to the domains restored, the oldest snapshots have none
+func restoreLegacyCounters(db *database, r *snapReader) error {
+	n, err := r.ReadUvarint()
+	if err == io.EOF {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	for i := uint64(0); i < n; i++ {
+		epoch, err := r.ReadString()
+		if err != nil {
+			return err
+		}
+		name, err := r.ReadString()
+		if err != nil {
+			return err
+		}
+		count, err := r.ReadUvarint()
+		if err != nil {
+			return err
+		}
+		if count > snapMaxCounters {
+			return uhaha.ErrCorrupt
+		}
+		period := db.getPeriod(epoch, false)
+		if period == nil {
+			return uhaha.ErrCorrupt
+		}
+		v, found := period.Get(name)
+		if !found {
+			return uhaha.ErrCorrupt
+		}
+		d := v.(*domain)
+		for j := uint64(0); j < count; j++ {
+			t, err := r.ReadString()
+			if err != nil {
+				return err
+			}
+			if d.counters[t], err = r.ReadInt64(); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
 // #endregion -- SNAPSHOT & RESTORE
@@ -0,0 +1,312 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/tidwall/sds"
+	"github.com/tidwall/uhaha"
+)
+
+func persist(t *testing.T, db *database) *bytes.Buffer {
+	snap, err := snapshot(db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	buf := &bytes.Buffer{}
+	if err := snap.Persist(buf); err != nil {
+		t.Fatal(err)
+	}
+	return buf
+}
+
+func TestRestoreKeepsTickedEpoch(t *testing.T) {
+	db := &database{length: defaultEpochLength}
+	db.getPeriod("1b", true).Set("example.com", &domain{name: "example.com", counters: map[string]int64{"delivered": 1}})
+
+	// TICK moves the current epoch without creating its period
+	db.current = "1e"
+
+	v, err := restore(persist(t, db))
+	if err != nil {
+		t.Fatal(err)
+	}
+	restored := v.(*database)
+	if restored.current != "1e" || restored.retrieved != db.retrieved {
+		t.Fatalf("restored current %q retrieved %q, expected %q %q", restored.current, restored.retrieved, "1e", db.retrieved)
+	}
+	if restored.getPeriod("1b", false) == nil {
+		t.Fatal("period 1b not restored")
+	}
+}
+
+// Counters of example.com in the epoch 1a of the snapshots written by hand
+func expectDomain(t *testing.T, v interface{}, counters map[string]int64) *database {
+	db := v.(*database)
+	period := db.getPeriod("1a", false)
+	if period == nil {
+		t.Fatal("period 1a not restored")
+	}
+	d, found := period.Get("example.com")
+	if !found {
+		t.Fatal("example.com not restored")
+	}
+	got := d.(*domain).counters
+	if len(got) != len(counters) {
+		t.Fatalf("restored counters %v, expected %v", got, counters)
+	}
+	for k, count := range counters {
+		if got[k] != count {
+			t.Fatalf("restored counters %v, expected %v", got, counters)
+		}
+	}
+	return db
+}
+
+func TestRestoreLegacy(t *testing.T) {
+	buf := &bytes.Buffer{}
+	w := sds.NewWriter(buf)
+	w.WriteString("1a")
+	w.WriteString("19")
+	w.WriteUvarint(1)
+	w.WriteString("1a")
+	w.WriteString("example.com")
+	w.WriteInt64(3)
+	w.WriteInt64(1)
+	w.Flush()
+
+	v, err := restore(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	db := expectDomain(t, v, map[string]int64{"delivered": 3, "bounced": 1})
+	if db.length != defaultEpochLength || db.current != "1a" || db.retrieved != "19" {
+		t.Fatalf("restored %q %q %d", db.current, db.retrieved, db.length)
+	}
+}
+
+func TestRestoreLegacyCounters(t *testing.T) {
+	buf := &bytes.Buffer{}
+	w := sds.NewWriter(buf)
+	w.WriteString("1a")
+	w.WriteString("19")
+	w.WriteUvarint(1)
+	w.WriteString("1a")
+	w.WriteString("example.com")
+	w.WriteInt64(3)
+	w.WriteInt64(0)
+	w.WriteInt64(60)
+	w.WriteUvarint(1)
+	w.WriteString("1a")
+	w.WriteString("example.com")
+	w.WriteUvarint(1)
+	w.WriteString("opened")
+	w.WriteInt64(2)
+	w.Flush()
+
+	v, err := restore(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	db := expectDomain(t, v, map[string]int64{"delivered": 3, "opened": 2})
+	if db.length != 60 {
+		t.Fatalf("restored length %d", db.length)
+	}
+}
+
+func TestRestoreV1(t *testing.T) {
+	buf := bytes.NewBufferString(snapMagic)
+	w := sds.NewWriter(buf)
+	w.WriteUvarint(1)
+	w.WriteString("1a")
+	w.WriteString("19")
+	w.WriteInt64(60)
+	w.WriteUvarint(1)
+	w.WriteString("1a")
+	w.WriteString("example.com")
+	w.WriteUvarint(2)
+	w.WriteString("delivered")
+	w.WriteInt64(3)
+	w.WriteString("opened")
+	w.WriteInt64(2)
+	w.Flush()
+
+	v, err := restore(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	db := expectDomain(t, v, map[string]int64{"delivered": 3, "opened": 2})
+	if db.length != 60 || db.maxEpochs != 0 {
+		t.Fatalf("restored length %d max epochs %d", db.length, db.maxEpochs)
+	}
+}
+
+func TestRestoreV2(t *testing.T) {
+	db := &database{length: 60, maxEpochs: 10, maxDomains: 1000, evictions: 2}
+	db.getPeriod("1a", true).Set("example.com", &domain{name: "example.com", counters: map[string]int64{"delivered": 3, "opened": 2}})
+
+	v, err := restore(persist(t, db))
+	if err != nil {
+		t.Fatal(err)
+	}
+	restored := expectDomain(t, v, map[string]int64{"delivered": 3, "opened": 2})
+	if restored.length != 60 || restored.maxEpochs != 10 || restored.maxDomains != 1000 || restored.evictions != 2 || restored.size != 1 {
+		t.Fatalf("restored %+v", restored)
+	}
+}
+
+func TestRestoreTruncated(t *testing.T) {
+	db := &database{length: 60}
+	db.getPeriod("1a", true).Set("example.com", &domain{name: "example.com", counters: map[string]int64{"delivered": 3}})
+	data := persist(t, db).Bytes()
+
+	for _, n := range []int{len(snapMagic) + 1, len(data) / 2, len(data) - 1} {
+		if _, err := restore(bytes.NewReader(data[:n])); err != errSnapTruncated {
+			t.Fatalf("restore of %d bytes out of %d: %v", n, len(data), err)
+		}
+	}
+}
+
+func TestRestoreGarbage(t *testing.T) {
+	huge := func(prefix string) []byte {
+		buf := bytes.NewBufferString(prefix)
+		w := sds.NewWriter(buf)
+		w.WriteUvarint(2)
+		w.WriteUvarint(1 << 62)
+		w.Flush()
+		return buf.Bytes()
+	}
+	counters := bytes.NewBufferString(snapMagic)
+	w := sds.NewWriter(counters)
+	w.WriteUvarint(1)
+	w.WriteString("1a")
+	w.WriteString("19")
+	w.WriteInt64(60)
+	w.WriteUvarint(1)
+	w.WriteString("1a")
+	w.WriteString("example.com")
+	w.WriteUvarint(1 << 62)
+	w.Flush()
+
+	inputs := map[string][]byte{
+		"huge string":   huge(snapMagic),
+		"huge counters": counters.Bytes(),
+		"version":       append([]byte(snapMagic), 99),
+		"bytes":         []byte("\xff\xff\xff\xff\xff\xff\xff\xff\xff\xff\xff"),
+	}
+	for name, data := range inputs {
+		if _, err := restore(bytes.NewReader(data)); err == nil {
+			t.Fatalf("restore of %s succeeded", name)
+		}
+	}
+	if _, err := restore(bytes.NewReader(huge(snapMagic))); !errors.Is(err, uhaha.ErrCorrupt) {
+		t.Fatalf("restore of a huge string: %v", err)
+	}
+}
+
+// Machine of the commands, only its data is used
+type testMachine struct {
+	uhaha.Machine
+	db *database
+}
+
+func (m testMachine) Data() interface{} {
+	return m.db
+}
+
+// Period of the domains given, the current epoch being the next one
+func pagedDatabase(epoch string, names ...string) *database {
+	db := &database{length: defaultEpochLength}
+	p := db.getPeriod(epoch, true)
+	for _, name := range names {
+		db.incrDomain(p, name, map[string]int64{"delivered": 1})
+	}
+	db.getPeriod(nextEpoch(epoch), true)
+	return db
+}
+
+// Call a paginated command and return the next cursor and the names of the page
+func page(t *testing.T, cmd func(uhaha.Machine, []string) (interface{}, error), db *database, args ...string) (string, []string) {
+	v, err := cmd(testMachine{db: db}, args)
+	if err != nil {
+		t.Fatal(args, err)
+	}
+	arr := v.([]string)
+	var names []string
+	for i := 1; i < len(arr); {
+		names = append(names, arr[i])
+		n, _ := strconv.Atoi(arr[i+1])
+		i += 2 + 2*n
+	}
+	return arr[0], names
+}
+
+func expectPage(t *testing.T, cursor string, names []string, expectedCursor string, expected ...string) {
+	if cursor != expectedCursor || strings.Join(names, ",") != strings.Join(expected, ",") {
+		t.Fatalf("page %q %v, expected %q %v", cursor, names, expectedCursor, expected)
+	}
+}
+
+func TestScanExactPages(t *testing.T) {
+	db := pagedDatabase("1a", "a.com", "b.com", "c.com", "d.com")
+
+	cursor, names := page(t, cmdSCAN, db, "SCAN", "1a", "COUNT", "2")
+	expectPage(t, cursor, names, "b.com", "a.com", "b.com")
+
+	// The last page is full, the cursor is already empty
+	cursor, names = page(t, cmdSCAN, db, "SCAN", "1a", "CURSOR", cursor, "COUNT", "2")
+	expectPage(t, cursor, names, "", "c.com", "d.com")
+
+	cursor, names = page(t, cmdSCAN, db, "SCAN", "1a", "COUNT", "4")
+	expectPage(t, cursor, names, "", "a.com", "b.com", "c.com", "d.com")
+
+	cursor, names = page(t, cmdSCAN, db, "SCAN", "1z", "COUNT", "2")
+	expectPage(t, cursor, names, "")
+}
+
+func TestScanDeletedCursor(t *testing.T) {
+	db := pagedDatabase("1a", "a.com", "b.com", "c.com", "d.com")
+
+	cursor, names := page(t, cmdSCAN, db, "SCAN", "1a", "COUNT", "2")
+	expectPage(t, cursor, names, "b.com", "a.com", "b.com")
+
+	// The domains after the cursor are returned even once the cursor is gone
+	db.getPeriod("1a", false).Delete("b.com")
+	cursor, names = page(t, cmdSCAN, db, "SCAN", "1a", "CURSOR", cursor, "COUNT", "2")
+	expectPage(t, cursor, names, "", "c.com", "d.com")
+
+	cursor, names = page(t, cmdSCAN, db, "SCAN", "1a", "CURSOR", "bb.com", "COUNT", "1")
+	expectPage(t, cursor, names, "c.com", "c.com")
+}
+
+func TestExtractRetrievedAgain(t *testing.T) {
+	db := pagedDatabase("1a", "a.com", "b.com", "c.com")
+	db.incrDomain(db.getPeriod("19", true), "old.com", map[string]int64{"delivered": 1})
+	db.current = "1b"
+
+	cursor, names := page(t, cmdEXTRACT, db, "EXTRACT", "1a", "COUNT", "2")
+	expectPage(t, cursor, names, "b.com", "a.com", "b.com")
+	if db.retrieved != "1a" || db.getPeriod("19", false) != nil {
+		t.Fatalf("retrieved %q, previous period kept", db.retrieved)
+	}
+
+	// The master resumes the retrieved epoch after its watermark
+	cursor, names = page(t, cmdEXTRACT, db, "EXTRACT", "1a", "CURSOR", cursor, "COUNT", "2")
+	expectPage(t, cursor, names, "", "c.com")
+
+	// A page extracted again, after a failed commit, is the same
+	cursor, names = page(t, cmdEXTRACT, db, "EXTRACT", "1a", "COUNT", "2")
+	expectPage(t, cursor, names, "b.com", "a.com", "b.com")
+	if db.retrieved != "1a" || db.getPeriod("1a", false) == nil {
+		t.Fatalf("retrieved %q, period 1a deleted", db.retrieved)
+	}
+
+	// The current epoch is only extracted right after the retrieved one
+	db.current = "1c"
+	if _, err := cmdEXTRACT(testMachine{db: db}, []string{"EXTRACT", "1c"}); err != uhaha.ErrInvalid {
+		t.Fatalf("extract of the current epoch after a gap: %v", err)
+	}
+}
@@ -4,13 +4,15 @@ go 1.16
 
 require (
 	github.com/garyburd/redigo v1.6.2 // indirect
-	github.com/gorilla/mux v1.8.0 // indirect
-	github.com/mailgun/catchall v0.0.0-20201202215914-70f18fad21e6 // indirect
-	github.com/tidwall/sds v0.1.0 // indirect
-	github.com/tidwall/tinybtree v1.1.0 // indirect
-	github.com/tidwall/uhaha v0.8.1 // indirect
-	github.com/tidwall/uhatools v0.4.1 // indirect
+	github.com/gorilla/mux v1.8.0
+	github.com/mailgun/catchall v0.0.0-20201202215914-70f18fad21e6
+	github.com/tidwall/sds v0.1.0
+	github.com/tidwall/tinybtree v1.1.0
+	github.com/tidwall/uhaha v0.8.1
+	github.com/tidwall/uhatools v0.4.1
 	github.com/tsliwowicz/go-wrk v0.0.0-20210628064207-cc6865c14ec7 // indirect
 	github.com/urfave/cli v1.22.5 // indirect
-	go.mongodb.org/mongo-driver v1.7.2 // indirect
+	go.etcd.io/bbolt v1.3.6
+	go.mongodb.org/mongo-driver v1.7.2
+	golang.org/x/net v0.0.0-20210614182718-04defd469f4e
 )
@@ -0,0 +1,121 @@
+// Package apierror writes the errors of the web servers as a JSON envelope
+// carrying a code, a message and the ID of the request.
+package apierror
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+
+	bolt "go.etcd.io/bbolt"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/x/mongo/driver/topology"
+)
+
+// Codes of the errors according to their HTTP status
+var codes = map[int]string{
+	400: "invalid_request",
+	401: "unauthorized",
+	403: "forbidden",
+	404: "not_found",
+	405: "method_not_allowed",
+	500: "internal",
+	503: "unavailable",
+}
+
+// Header carrying the ID of the request, given by the client or generated
+const requestIDHeader = "X-Request-ID"
+
+type contextKey struct{}
+
+// Error - Envelope of the error responses
+type Error struct {
+	Code      string `json:"code"`
+	Message   string `json:"message"`
+	RequestID string `json:"requestId"`
+}
+
+// Request ID - Middleware identifying every request, the ID is sent back in the response header
+func RequestID(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+
+		id := r.Header.Get(requestIDHeader)
+		if len(id) == 0 || len(id) > 128 {
+			b := make([]byte, 8)
+			rand.Read(b)
+			id = hex.EncodeToString(b)
+		}
+
+		w.Header().Set(requestIDHeader, id)
+		next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), contextKey{}, id)))
+	})
+}
+
+// Write - Send the error with the status, its message is given to the client
+func Write(w http.ResponseWriter, r *http.Request, status int, message string) {
+
+	code, found := codes[status]
+	if !found {
+		code = codes[500]
+	}
+	id, _ := r.Context().Value(contextKey{}).(string)
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(Error{Code: code, Message: message, RequestID: id})
+}
+
+// Not Found - Handler of the unknown routes
+func NotFound(w http.ResponseWriter, r *http.Request) {
+	Write(w, r, 404, "route not found")
+}
+
+// Method Not Allowed - Handler of the routes called with another method
+func MethodNotAllowed(w http.ResponseWriter, r *http.Request) {
+	Write(w, r, 405, "method not allowed")
+}
+
+// Invalid - Send the error of an invalid input, 400
+func Invalid(w http.ResponseWriter, r *http.Request, err error) {
+	Write(w, r, 400, err.Error())
+}
+
+// Backend - Send an error of the database or of the cluster, 503 when it is unreachable and 500 otherwise
+// The error itself is only logged
+func Backend(w http.ResponseWriter, r *http.Request, err error) {
+
+	id, _ := r.Context().Value(contextKey{}).(string)
+	fmt.Println("* Request", id, "failed :", err)
+
+	if Unavailable(err) {
+		Write(w, r, 503, "service temporarily unavailable")
+		return
+	}
+	Write(w, r, 500, "internal error")
+}
+
+// Unavailable - Whether the error comes from a database or a cluster which can't be reached in time
+func Unavailable(err error) bool {
+
+	var selection topology.ServerSelectionError
+	var network net.Error
+
+	switch {
+	case mongo.IsTimeout(err), mongo.IsNetworkError(err):
+		return true
+	case errors.As(err, &selection), errors.As(err, &network):
+		return true
+	case errors.Is(err, context.DeadlineExceeded), errors.Is(err, io.EOF), errors.Is(err, io.ErrUnexpectedEOF):
+		return true
+	case errors.Is(err, bolt.ErrTimeout):
+		return true
+	}
+
+	return false
+}
@@ -0,0 +1,25 @@
+// Package events validates the event types counted per domain, each type being
+// stored as a field of the domain documents of the master database.
+package events
+
+// Fields of the domain documents which can't be used as event types
+var reserved = map[string]bool{
+	"name":     true,
+	"reversed": true,
+	"lastseen": true,
+}
+
+// Valid Type - Event types are lowercase identifiers, the fields of the domains being reserved
+func ValidType(t string) bool {
+
+	if len(t) == 0 || t[0] < 'a' || t[0] > 'z' || reserved[t] {
+		return false
+	}
+	for _, c := range t {
+		if (c < 'a' || c > 'z') && (c < '0' || c > '9') && c != '_' {
+			return false
+		}
+	}
+
+	return true
+}
@@ -0,0 +1,248 @@
+// Package keys manages the API keys of the web servers, stored in MongoDB with hashed secrets,
+// and enforces their scopes on the routes.
+package keys
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"errors"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"catchall/internal/apierror"
+
+	"github.com/gorilla/mux"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// Scopes granted to the keys, admin grants every scope
+const (
+	EventsWrite = "events:write"
+	DomainsRead = "domains:read"
+	Admin       = "admin"
+)
+
+// Duration during which an authenticated key is not checked again in the database
+// A revoked key is therefore refused after this delay at most
+const cacheDuration = 30 * time.Second
+
+var ErrUnknownScope = errors.New("unknown scope")
+var ErrInvalidKey = errors.New("invalid API key")
+var ErrNotFound = errors.New("API key not found")
+
+// Key - API key, the secret is only known by its owner and stored hashed
+type Key struct {
+	ID        string     `json:"id"                  bson:"_id"`
+	Name      string     `json:"name"                bson:"name"`
+	Hash      string     `json:"-"                   bson:"hash"`
+	Scopes    []string   `json:"scopes"              bson:"scopes"`
+	CreatedAt time.Time  `json:"createdAt"           bson:"createdAt"`
+	ExpiresAt *time.Time `json:"expiresAt,omitempty" bson:"expiresAt,omitempty"`
+	RevokedAt *time.Time `json:"revokedAt,omitempty" bson:"revokedAt,omitempty"`
+}
+
+// Store - Keys of the collection and the keys authenticated recently
+type Store struct {
+	collection *mongo.Collection
+	mu         sync.Mutex
+	cache      map[string]cached
+}
+
+type cached struct {
+	key     *Key
+	checked time.Time
+}
+
+func NewStore(collection *mongo.Collection) *Store {
+	return &Store{collection: collection, cache: make(map[string]cached)}
+}
+
+// Parse Scopes - Comma separated list of known scopes
+func ParseScopes(list string) ([]string, error) {
+
+	var scopes []string
+	for _, scope := range strings.Split(list, ",") {
+		scope = strings.TrimSpace(scope)
+		if scope != EventsWrite && scope != DomainsRead && scope != Admin {
+			return nil, ErrUnknownScope
+		}
+		scopes = append(scopes, scope)
+	}
+
+	return scopes, nil
+}
+
+// Create - Save a new key and return the token given to its owner, made of the key id and the secret
+// The key never expires when ttl is zero
+func (s *Store) Create(ctx context.Context, name string, scopes []string, ttl time.Duration) (string, *Key, error) {
+
+	id, err := random(8)
+	if err != nil {
+		return "", nil, err
+	}
+	secret, err := random(32)
+	if err != nil {
+		return "", nil, err
+	}
+
+	key := &Key{ID: id, Name: name, Hash: hash(secret), Scopes: scopes, CreatedAt: time.Now().UTC()}
+	if ttl > 0 {
+		expiresAt := key.CreatedAt.Add(ttl)
+		key.ExpiresAt = &expiresAt
+	}
+
+	if _, err := s.collection.InsertOne(ctx, key); err != nil {
+		return "", nil, err
+	}
+
+	return id + "." + secret, key, nil
+}
+
+// List - Every key, including the expired and revoked ones
+func (s *Store) List(ctx context.Context) ([]*Key, error) {
+
+	findOptions := options.Find().SetSort(bson.D{{Key: "createdAt", Value: 1}})
+	cursor, err := s.collection.Find(ctx, bson.M{}, findOptions)
+	if err != nil {
+		return nil, err
+	}
+	defer cursor.Close(ctx)
+
+	keys := []*Key{}
+	for cursor.Next(ctx) {
+		key := &Key{}
+		if err := cursor.Decode(key); err != nil {
+			return nil, err
+		}
+		keys = append(keys, key)
+	}
+
+	return keys, cursor.Err()
+}
+
+// Revoke - Refuse the key from now on, the key is kept for the record
+func (s *Store) Revoke(ctx context.Context, id string) error {
+
+	query := bson.M{"_id": id, "revokedAt": bson.M{"$exists": false}}
+	update := bson.M{"$set": bson.M{"revokedAt": time.Now().UTC()}}
+
+	result, err := s.collection.UpdateOne(ctx, query, update)
+	if err != nil {
+		return err
+	}
+	if result.MatchedCount == 0 {
+		return ErrNotFound
+	}
+
+	s.mu.Lock()
+	delete(s.cache, id)
+	s.mu.Unlock()
+
+	return nil
+}
+
+// Authenticate - Retrieve the key of a token if the secret matches and the key is neither expired nor revoked
+func (s *Store) Authenticate(ctx context.Context, token string) (*Key, error) {
+
+	parts := strings.SplitN(token, ".", 2)
+	if len(parts) != 2 {
+		return nil, ErrInvalidKey
+	}
+	id, secret := parts[0], parts[1]
+	now := time.Now()
+
+	s.mu.Lock()
+	entry, found := s.cache[id]
+	s.mu.Unlock()
+
+	if !found || now.Sub(entry.checked) > cacheDuration {
+		key := &Key{}
+		err := s.collection.FindOne(ctx, bson.M{"_id": id}).Decode(key)
+		if err == mongo.ErrNoDocuments {
+			return nil, ErrInvalidKey
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		entry = cached{key: key, checked: now}
+		s.mu.Lock()
+		s.cache[id] = entry
+		s.mu.Unlock()
+	}
+
+	key := entry.key
+	if subtle.ConstantTimeCompare([]byte(key.Hash), []byte(hash(secret))) != 1 {
+		return nil, ErrInvalidKey
+	}
+	if key.RevokedAt != nil || (key.ExpiresAt != nil && now.After(*key.ExpiresAt)) {
+		return nil, ErrInvalidKey
+	}
+
+	return key, nil
+}
+
+// Allows - Whether the key grants the scope
+func (key *Key) Allows(scope string) bool {
+	for _, granted := range key.Scopes {
+		if granted == scope || granted == Admin {
+			return true
+		}
+	}
+	return false
+}
+
+// Require - Middleware refusing the requests without a valid key, 401, or without the scope, 403
+// The token is given as "Authorization: Bearer <token>" or "X-API-Key: <token>"
+// Without store, with the open access, the requests are all accepted
+func (s *Store) Require(scope string) mux.MiddlewareFunc {
+	return func(next http.Handler) http.Handler {
+		if s == nil {
+			return next
+		}
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+
+			token := r.Header.Get("X-API-Key")
+			if auth := r.Header.Get("Authorization"); strings.HasPrefix(auth, "Bearer ") {
+				token = strings.TrimPrefix(auth, "Bearer ")
+			}
+
+			key, err := s.Authenticate(r.Context(), token)
+			if err == ErrInvalidKey {
+				apierror.Write(w, r, 401, err.Error())
+				return
+			}
+			if err != nil {
+				apierror.Backend(w, r, err)
+				return
+			}
+			if !key.Allows(scope) {
+				apierror.Write(w, r, 403, "missing scope "+scope)
+				return
+			}
+
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+func random(size int) (string, error) {
+	b := make([]byte, size)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
+
+func hash(secret string) string {
+	sum := sha256.Sum256([]byte(secret))
+	return hex.EncodeToString(sum[:])
+}
@@ -0,0 +1,110 @@
+// Package names canonicalizes the domain names received by the web servers,
+// so that the same domain is always counted and looked up under the same name.
+package names
+
+import (
+	"errors"
+	"strings"
+
+	"golang.org/x/net/idna"
+)
+
+// Maximum length of a domain name and of one of its labels
+const (
+	maxLength      = 253
+	maxLabelLength = 63
+)
+
+// ErrInvalid is returned for a name which is not a valid domain name
+var ErrInvalid = errors.New("invalid domain name")
+
+// Canonical - Lowercase ASCII form of the domain name, without trailing dot and with IDN labels in punycode
+// The name needs at least two labels of 1 to 63 letters, digits or hyphens, the top-level one not all digits
+// so that the IP addresses are rejected
+func Canonical(name string) (string, error) {
+
+	name = strings.TrimSuffix(strings.TrimSpace(name), ".")
+	if len(name) == 0 {
+		return "", ErrInvalid
+	}
+
+	ascii, err := idna.Lookup.ToASCII(strings.ToLower(name))
+	if err != nil {
+		return "", ErrInvalid
+	}
+	if len(ascii) > maxLength {
+		return "", ErrInvalid
+	}
+
+	labels := strings.Split(ascii, ".")
+	if len(labels) < 2 {
+		return "", ErrInvalid
+	}
+	for _, label := range labels {
+		if !validLabel(label) {
+			return "", ErrInvalid
+		}
+	}
+	if strings.Trim(labels[len(labels)-1], "0123456789") == "" {
+		return "", ErrInvalid
+	}
+
+	return ascii, nil
+}
+
+func validLabel(label string) bool {
+	if len(label) == 0 || len(label) > maxLabelLength {
+		return false
+	}
+	if label[0] == '-' || label[len(label)-1] == '-' {
+		return false
+	}
+	return validPart(label)
+}
+
+// Fragment - Canonical form of a part of a domain name, as given to search the names by prefix or suffix
+// The labels are lowercased and the IDN ones converted to punycode, a partial IDN label only matching a whole one
+func Fragment(fragment string) (string, error) {
+
+	labels := strings.Split(strings.ToLower(strings.TrimSpace(fragment)), ".")
+	for i, label := range labels {
+		if isASCII(label) {
+			if !validPart(label) {
+				return "", ErrInvalid
+			}
+			continue
+		}
+		converted, err := idna.Lookup.ToASCII(label)
+		if err != nil {
+			return "", ErrInvalid
+		}
+		labels[i] = converted
+	}
+
+	canonical := strings.Join(labels, ".")
+	if len(canonical) > maxLength {
+		return "", ErrInvalid
+	}
+
+	return canonical, nil
+}
+
+func isASCII(label string) bool {
+	for i := 0; i < len(label); i++ {
+		if label[i] >= 0x80 {
+			return false
+		}
+	}
+	return true
+}
+
+// Valid Part - Letters, digits and hyphens of a label, possibly partial or empty
+func validPart(label string) bool {
+	for i := 0; i < len(label); i++ {
+		c := label[i]
+		if (c < 'a' || c > 'z') && (c < '0' || c > '9') && c != '-' {
+			return false
+		}
+	}
+	return true
+}
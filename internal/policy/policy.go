@@ -0,0 +1,177 @@
+// Package policy classifies the domains from their counters with thresholds loaded from a JSON file,
+// reloaded when it changes, so that the master services classify them the same way.
+package policy
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// Statuses of the domains
+const (
+	Unknown     = "Unknown"
+	CatchAll    = "CatchAll"
+	NonCatchAll = "NonCatchAll"
+)
+
+// Interval between two checks of the policy file
+const interval = 5 * time.Second
+
+// Rule - Thresholds used to classify a domain from its counters
+type Rule struct {
+	MinDelivered  int64   `json:"minDelivered"`  // deliveries needed to be classified CatchAll
+	MaxBounceRate float64 `json:"maxBounceRate"` // bounce rate above which the domain is NonCatchAll
+	MinSamples    int64   `json:"minSamples"`    // events needed before classifying the domain
+	CatchAllRate  float64 `json:"catchAllRate"`  // bounce rate below which the domain is deemed CatchAll by the confidence
+}
+
+// Policy - Default rule and the rules overridden per top level domain, e.g. "edu" or "co.uk"
+type Policy struct {
+	Rule
+	TLDs     map[string]Rule `json:"tlds"`
+	Source   string          `json:"source,omitempty"`
+	LoadedAt time.Time       `json:"loadedAt"`
+}
+
+var active atomic.Value
+
+func init() {
+	active.Store(Default())
+}
+
+// Default - Any bounce is NonCatchAll and 1000 deliveries are CatchAll
+func Default() *Policy {
+	return &Policy{
+		Rule:     Rule{MinDelivered: 1000, CatchAllRate: 0.01},
+		TLDs:     map[string]Rule{},
+		LoadedAt: time.Now(),
+	}
+}
+
+// Load - Read the policy file, the fields missing in a TLD rule are the default ones
+func Load(path string) (*Policy, error) {
+
+	var file struct {
+		Rule
+		TLDs map[string]json.RawMessage `json:"tlds"`
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	p := Default()
+	file.Rule = p.Rule
+	if err := json.Unmarshal(data, &file); err != nil {
+		return nil, err
+	}
+	if err := file.Rule.validate(); err != nil {
+		return nil, err
+	}
+
+	p.Rule = file.Rule
+	p.Source = path
+
+	for tld, raw := range file.TLDs {
+		r := p.Rule
+		if err := json.Unmarshal(raw, &r); err != nil {
+			return nil, err
+		}
+		if err := r.validate(); err != nil {
+			return nil, fmt.Errorf("tld %s: %w", tld, err)
+		}
+		p.TLDs[strings.Trim(strings.ToLower(tld), ".")] = r
+	}
+
+	return p, nil
+}
+
+func (r Rule) validate() error {
+	if r.MinDelivered < 0 || r.MinSamples < 0 {
+		return fmt.Errorf("thresholds can't be negative")
+	}
+	if r.MaxBounceRate < 0 || r.MaxBounceRate > 1 {
+		return fmt.Errorf("bounce rate must be between 0 and 1")
+	}
+	if r.CatchAllRate <= 0 || r.CatchAllRate > 1 {
+		return fmt.Errorf("catch-all rate must be above 0 and at most 1")
+	}
+	return nil
+}
+
+// Watch - Load the policy file and reload it when it changes
+// An invalid file is reported and the previous policy is kept
+func Watch(path string) error {
+
+	p, err := Load(path)
+	if err != nil {
+		return err
+	}
+	active.Store(p)
+
+	info, err := os.Stat(path)
+	if err != nil {
+		return err
+	}
+
+	go func() {
+		modified := info.ModTime()
+		for {
+			time.Sleep(interval)
+
+			info, err := os.Stat(path)
+			if err != nil || info.ModTime().Equal(modified) {
+				continue
+			}
+			modified = info.ModTime()
+
+			p, err := Load(path)
+			if err != nil {
+				fmt.Println("* Policy not reloaded :", err)
+				continue
+			}
+			active.Store(p)
+			fmt.Println("* Policy reloaded from", path)
+		}
+	}()
+
+	return nil
+}
+
+// Active - Policy loaded last, the default one without file
+func Active() *Policy {
+	return active.Load().(*Policy)
+}
+
+// Rule For - Rule of the longest top level domain overridden, the default rule otherwise
+func (p *Policy) RuleFor(name string) Rule {
+	labels := strings.Split(strings.ToLower(name), ".")
+	for i := 1; i < len(labels); i++ {
+		if r, ok := p.TLDs[strings.Join(labels[i:], ".")]; ok {
+			return r
+		}
+	}
+	return p.Rule
+}
+
+// Classify - Status of the counters according to the rule
+func (r Rule) Classify(delivered int64, bounced int64) string {
+
+	total := delivered + bounced
+
+	if total < r.MinSamples || total == 0 {
+		return Unknown
+	}
+	if bounced > 0 && float64(bounced)/float64(total) > r.MaxBounceRate {
+		return NonCatchAll
+	}
+	if delivered < r.MinDelivered {
+		return Unknown
+	}
+	return CatchAll
+}
@@ -0,0 +1,217 @@
+package storage
+
+import (
+	"context"
+	"encoding/json"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+// Time to wait for the file held by another process before failing with bolt.ErrTimeout
+const boltLockTimeout = 10 * time.Second
+
+var domainsBucket = []byte("domains")
+var watermarksBucket = []byte("watermarks")
+
+// Bolt - Store embedded in a bbolt file, for the deployments without MongoDB
+// The file is locked by the process opening it until it is closed, exclusively by the aggregator service
+// and shared by the read only opens, a single process can therefore write the file
+type Bolt struct {
+	db *bolt.DB
+}
+
+type boltTx struct {
+	ctx context.Context
+	tx  *bolt.Tx
+}
+
+// The counters of a domain, keyed by its name
+type boltDomain struct {
+	Counters map[string]int64 `json:"counters"`
+	LastSeen time.Time        `json:"lastSeen"`
+}
+
+// Open Bolt - Create the file and its buckets when missing, or open an existing file read only
+func OpenBolt(path string, readOnly bool) (*Bolt, error) {
+
+	db, err := bolt.Open(path, 0600, &bolt.Options{Timeout: boltLockTimeout, ReadOnly: readOnly})
+	if err != nil {
+		return nil, err
+	}
+	if readOnly {
+		return &Bolt{db: db}, nil
+	}
+
+	err = db.Update(func(tx *bolt.Tx) error {
+		if _, err := tx.CreateBucketIfNotExists(domainsBucket); err != nil {
+			return err
+		}
+		_, err := tx.CreateBucketIfNotExists(watermarksBucket)
+		return err
+	})
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+
+	return &Bolt{db: db}, nil
+}
+
+// Update - The transactions are run one at a time, bolt.ErrDatabaseReadOnly when opened read only
+func (b *Bolt) Update(ctx context.Context, fn func(tx Tx) error) error {
+	return b.db.Update(func(tx *bolt.Tx) error {
+		return fn(&boltTx{ctx: ctx, tx: tx})
+	})
+}
+
+func (b *Bolt) Get(ctx context.Context, name string) (*Domain, error) {
+
+	found, err := b.GetMany(ctx, []string{name})
+	if err != nil {
+		return nil, err
+	}
+	d, exists := found[name]
+	if !exists {
+		return nil, ErrNotFound
+	}
+
+	return d, nil
+}
+
+func (b *Bolt) GetMany(ctx context.Context, names []string) (map[string]*Domain, error) {
+
+	found := make(map[string]*Domain, len(names))
+
+	err := b.db.View(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket(domainsBucket)
+		for _, name := range names {
+			d, err := getBoltDomain(bucket, name)
+			if err != nil {
+				return err
+			}
+			if d != nil {
+				found[name] = d
+			}
+		}
+		return nil
+	})
+
+	return found, err
+}
+
+func (b *Bolt) Watermark(ctx context.Context, cluster string) (Watermark, bool, error) {
+
+	var w *watermark
+	err := b.db.View(func(tx *bolt.Tx) error {
+		var err error
+		w, err = getBoltWatermark(tx, cluster)
+		return err
+	})
+	if err != nil || w == nil {
+		return Watermark{}, false, err
+	}
+
+	return Watermark{w.Epoch, w.Cursor}, true, nil
+}
+
+func (b *Bolt) Close() error {
+	return b.db.Close()
+}
+
+func (tx *boltTx) Context() context.Context {
+	return tx.ctx
+}
+
+func (tx *boltTx) Increment(increments []Increment) error {
+
+	bucket := tx.tx.Bucket(domainsBucket)
+
+	for _, i := range increments {
+		if len(i.Counters) == 0 {
+			continue
+		}
+
+		d, err := getBoltDomain(bucket, i.Name)
+		if err != nil {
+			return err
+		}
+		if d == nil {
+			d = &Domain{Name: i.Name, Counters: make(map[string]int64)}
+		}
+		add(d, i)
+
+		value, err := json.Marshal(boltDomain{Counters: d.Counters, LastSeen: d.LastSeen})
+		if err != nil {
+			return err
+		}
+		if err := bucket.Put([]byte(i.Name), value); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (tx *boltTx) Watermark(cluster string) (Watermark, bool, error) {
+
+	w, err := getBoltWatermark(tx.tx, cluster)
+	if err != nil || w == nil {
+		return Watermark{}, false, err
+	}
+
+	return Watermark{w.Epoch, w.Cursor}, true, nil
+}
+
+func (tx *boltTx) SetWatermark(cluster string, w Watermark, token int64) error {
+
+	stored, err := getBoltWatermark(tx.tx, cluster)
+	if err != nil {
+		return err
+	}
+	if stored != nil && stored.Token > token {
+		return ErrFenced
+	}
+
+	value, err := json.Marshal(watermark{Epoch: w.Epoch, Cursor: w.Cursor, Token: token})
+	if err != nil {
+		return err
+	}
+
+	return tx.tx.Bucket(watermarksBucket).Put([]byte(cluster), value)
+}
+
+// Get Bolt Domain - Decode a domain of the bucket, nil when missing
+func getBoltDomain(bucket *bolt.Bucket, name string) (*Domain, error) {
+
+	value := bucket.Get([]byte(name))
+	if value == nil {
+		return nil, nil
+	}
+
+	stored := &boltDomain{}
+	if err := json.Unmarshal(value, stored); err != nil {
+		return nil, err
+	}
+	if stored.Counters == nil {
+		stored.Counters = make(map[string]int64)
+	}
+
+	return &Domain{Name: name, Counters: stored.Counters, LastSeen: stored.LastSeen}, nil
+}
+
+// Get Bolt Watermark - Decode the watermark of a cluster, nil when missing
+func getBoltWatermark(tx *bolt.Tx, cluster string) (*watermark, error) {
+
+	value := tx.Bucket(watermarksBucket).Get([]byte(cluster))
+	if value == nil {
+		return nil, nil
+	}
+
+	w := &watermark{}
+	if err := json.Unmarshal(value, w); err != nil {
+		return nil, err
+	}
+
+	return w, nil
+}
@@ -0,0 +1,152 @@
+package storage
+
+import (
+	"context"
+	"sync"
+)
+
+// Memory - Store living as long as the process, for the tests
+// It can't be shared by the aggregator service and the web server
+type Memory struct {
+	mu         sync.RWMutex
+	domains    map[string]*Domain
+	watermarks map[string]watermark
+}
+
+// The watermark of a cluster and the fencing token it was saved with
+type watermark struct {
+	Epoch  int64  `json:"epoch"`
+	Cursor string `json:"cursor,omitempty"`
+	Token  int64  `json:"token"`
+}
+
+// The writes of a transaction are kept aside and applied once it succeeds
+type memoryTx struct {
+	ctx        context.Context
+	store      *Memory
+	increments []Increment
+	watermarks map[string]watermark
+}
+
+func NewMemory() *Memory {
+	return &Memory{domains: make(map[string]*Domain), watermarks: make(map[string]watermark)}
+}
+
+// Update - The transactions are run one at a time
+func (m *Memory) Update(ctx context.Context, fn func(tx Tx) error) error {
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	tx := &memoryTx{ctx: ctx, store: m, watermarks: make(map[string]watermark)}
+	if err := fn(tx); err != nil {
+		return err
+	}
+
+	for _, i := range tx.increments {
+		d, found := m.domains[i.Name]
+		if !found {
+			d = &Domain{Name: i.Name, Counters: make(map[string]int64)}
+			m.domains[i.Name] = d
+		}
+		add(d, i)
+	}
+	for cluster, w := range tx.watermarks {
+		m.watermarks[cluster] = w
+	}
+
+	return nil
+}
+
+func (m *Memory) Get(ctx context.Context, name string) (*Domain, error) {
+
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	d, found := m.domains[name]
+	if !found {
+		return nil, ErrNotFound
+	}
+
+	return copyDomain(d), nil
+}
+
+func (m *Memory) GetMany(ctx context.Context, names []string) (map[string]*Domain, error) {
+
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	found := make(map[string]*Domain, len(names))
+	for _, name := range names {
+		if d, exists := m.domains[name]; exists {
+			found[name] = copyDomain(d)
+		}
+	}
+
+	return found, nil
+}
+
+func (m *Memory) Watermark(ctx context.Context, cluster string) (Watermark, bool, error) {
+
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	w, found := m.watermarks[cluster]
+
+	return Watermark{w.Epoch, w.Cursor}, found, nil
+}
+
+func (m *Memory) Close() error {
+	return nil
+}
+
+func (tx *memoryTx) Context() context.Context {
+	return tx.ctx
+}
+
+func (tx *memoryTx) Increment(increments []Increment) error {
+	for _, i := range increments {
+		if len(i.Counters) > 0 {
+			tx.increments = append(tx.increments, i)
+		}
+	}
+	return nil
+}
+
+func (tx *memoryTx) Watermark(cluster string) (Watermark, bool, error) {
+
+	w, found := tx.watermarks[cluster]
+	if !found {
+		w, found = tx.store.watermarks[cluster]
+	}
+
+	return Watermark{w.Epoch, w.Cursor}, found, nil
+}
+
+func (tx *memoryTx) SetWatermark(cluster string, w Watermark, token int64) error {
+
+	if stored, found := tx.store.watermarks[cluster]; found && stored.Token > token {
+		return ErrFenced
+	}
+	tx.watermarks[cluster] = watermark{Epoch: w.Epoch, Cursor: w.Cursor, Token: token}
+
+	return nil
+}
+
+// Add - Add the counters of the increment to the domain, keeping the latest time it was seen
+func add(d *Domain, i Increment) {
+	for t, count := range i.Counters {
+		d.Counters[t] += count
+	}
+	if i.Seen.After(d.LastSeen) {
+		d.LastSeen = i.Seen
+	}
+}
+
+func copyDomain(d *Domain) *Domain {
+	c := &Domain{Name: d.Name, Counters: make(map[string]int64, len(d.Counters)), LastSeen: d.LastSeen}
+	for t, count := range d.Counters {
+		c.Counters[t] = count
+	}
+	return c
+}
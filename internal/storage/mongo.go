@@ -0,0 +1,220 @@
+package storage
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// Time to find an available database server before failing a request
+const serverSelectionTimeout = 5 * time.Second
+
+// Mongo - Store of the domains and watermarks collections of the catchall database
+// The domains also carry their reversed name for the suffix searches of the listing
+type Mongo struct {
+	database *mongo.Database
+}
+
+type mongoTx struct {
+	sc       mongo.SessionContext
+	database *mongo.Database
+}
+
+// The counters of every event type are stored alongside the name
+type mongoDomain struct {
+	ID       primitive.ObjectID `bson:"_id,omitempty"`
+	Name     string             `bson:"name"`
+	Reversed string             `bson:"reversed,omitempty"`
+	LastSeen *time.Time         `bson:"lastSeen,omitempty"`
+	Counters map[string]int64   `bson:",inline"`
+}
+
+// Open Mongo - Connect to the MongoDB server of the address
+func OpenMongo(address string) (*Mongo, error) {
+
+	// The requests fail fast while the database can't be reached
+	clientOptions := options.Client().ApplyURI("mongodb://" + address).SetServerSelectionTimeout(serverSelectionTimeout)
+	client, err := mongo.Connect(context.TODO(), clientOptions)
+	if err != nil {
+		return nil, err
+	}
+
+	return &Mongo{database: client.Database("catchall")}, nil
+}
+
+// Database - Database of the features only kept in MongoDB, nil for the other stores
+func Database(store Store) *mongo.Database {
+	if m, ok := store.(*Mongo); ok {
+		return m.database
+	}
+	return nil
+}
+
+func (m *Mongo) Update(ctx context.Context, fn func(tx Tx) error) error {
+
+	session, err := m.database.Client().StartSession()
+	if err != nil {
+		return err
+	}
+	defer session.EndSession(context.TODO())
+
+	_, err = session.WithTransaction(ctx, func(sc mongo.SessionContext) (interface{}, error) {
+		return nil, fn(&mongoTx{sc: sc, database: m.database})
+	})
+
+	return err
+}
+
+func (m *Mongo) Get(ctx context.Context, name string) (*Domain, error) {
+
+	d := &mongoDomain{}
+	err := m.database.Collection("domains").FindOne(ctx, bson.M{"name": name}).Decode(d)
+	if err == mongo.ErrNoDocuments {
+		return nil, ErrNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	return d.domain(), nil
+}
+
+func (m *Mongo) GetMany(ctx context.Context, names []string) (map[string]*Domain, error) {
+
+	cursor, err := m.database.Collection("domains").Find(ctx, bson.M{"name": bson.M{"$in": names}})
+	if err != nil {
+		return nil, err
+	}
+	defer cursor.Close(ctx)
+
+	found := make(map[string]*Domain, len(names))
+	for cursor.Next(ctx) {
+		d := &mongoDomain{}
+		if err := cursor.Decode(d); err != nil {
+			return nil, err
+		}
+		found[d.Name] = d.domain()
+	}
+
+	return found, cursor.Err()
+}
+
+func (m *Mongo) Watermark(ctx context.Context, cluster string) (Watermark, bool, error) {
+	return getWatermark(ctx, m.database, cluster)
+}
+
+func (m *Mongo) Close() error {
+	return m.database.Client().Disconnect(context.TODO())
+}
+
+func (d *mongoDomain) domain() *Domain {
+	domain := &Domain{Name: d.Name, Counters: d.Counters}
+	if d.LastSeen != nil {
+		domain.LastSeen = *d.LastSeen
+	}
+	if domain.Counters == nil {
+		domain.Counters = make(map[string]int64)
+	}
+	return domain
+}
+
+func (tx *mongoTx) Context() context.Context {
+	return tx.sc
+}
+
+// Increment - Update the domains using bulk write, with their reversed name
+func (tx *mongoTx) Increment(increments []Increment) error {
+
+	var operations []mongo.WriteModel
+
+	bulkOption := options.BulkWriteOptions{}
+	bulkOption.SetOrdered(true)
+
+	for _, i := range increments {
+		if len(i.Counters) == 0 {
+			continue
+		}
+
+		counters := bson.M{}
+		for t, count := range i.Counters {
+			counters[t] = count
+		}
+
+		operation := mongo.NewUpdateOneModel()
+		operation.SetFilter(bson.M{"name": i.Name})
+		operation.SetUpdate(bson.M{
+			"$inc": counters,
+			"$max": bson.M{"lastSeen": i.Seen},
+			"$set": bson.M{"reversed": Reverse(i.Name)},
+		})
+		operation.SetUpsert(true)
+		operations = append(operations, operation)
+	}
+
+	if len(operations) == 0 {
+		return nil
+	}
+
+	_, err := tx.database.Collection("domains").BulkWrite(tx.sc, operations, &bulkOption)
+	if err != nil {
+		return err
+	}
+	fmt.Println("* Domains upserted in the database :", len(operations))
+
+	return nil
+}
+
+func (tx *mongoTx) Watermark(cluster string) (Watermark, bool, error) {
+	return getWatermark(tx.sc, tx.database, cluster)
+}
+
+// Set Watermark - A watermark saved with a newer token can't be overwritten
+func (tx *mongoTx) SetWatermark(cluster string, w Watermark, token int64) error {
+
+	query := bson.M{"_id": cluster, "$or": bson.A{
+		bson.M{"token": bson.M{"$lte": token}},
+		bson.M{"token": bson.M{"$exists": false}},
+	}}
+	updateOption := options.Update().SetUpsert(true)
+	update := bson.M{"$set": bson.M{"epoch": w.Epoch, "cursor": w.Cursor, "token": token}}
+
+	// The watermark exists with a newer token, the upsert conflicts with it
+	_, err := tx.database.Collection("watermarks").UpdateOne(tx.sc, query, update, updateOption)
+	if mongo.IsDuplicateKeyError(err) {
+		return ErrFenced
+	}
+
+	return err
+}
+
+func getWatermark(ctx context.Context, database *mongo.Database, cluster string) (Watermark, bool, error) {
+
+	var watermark struct {
+		Epoch  int64  `bson:"epoch"`
+		Cursor string `bson:"cursor"`
+	}
+
+	err := database.Collection("watermarks").FindOne(ctx, bson.M{"_id": cluster}).Decode(&watermark)
+	if err == mongo.ErrNoDocuments {
+		return Watermark{}, false, nil
+	}
+	if err != nil {
+		return Watermark{}, false, err
+	}
+
+	return Watermark{watermark.Epoch, watermark.Cursor}, true, nil
+}
+
+// Reverse - Name read from right to left, e.g. ude.elpmaxe for example.edu
+func Reverse(name string) string {
+	b := []byte(name)
+	for i, j := 0, len(b)-1; i < j; i, j = i+1, j-1 {
+		b[i], b[j] = b[j], b[i]
+	}
+	return string(b)
+}
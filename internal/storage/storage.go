@@ -0,0 +1,82 @@
+// Package storage keeps the aggregated statistics of the domains and the watermarks of the clusters
+// in MongoDB or in an embedded bbolt file, and in memory for the tests.
+package storage
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"time"
+)
+
+var ErrNotFound = errors.New("domain not found")
+var ErrFenced = errors.New("fencing token superseded by another aggregator service")
+
+// Domain - Counters of every event type of a domain, LastSeen is zero when unknown
+type Domain struct {
+	Name     string
+	Counters map[string]int64
+	LastSeen time.Time
+}
+
+// Watermark - Progress of a cluster, the last epoch committed and the cursor of the next page of the following epoch
+// The cursor is empty while no page of the following epoch is committed
+type Watermark struct {
+	Epoch  int64
+	Cursor string
+}
+
+// Increment - Counters to add to a domain seen at the given time
+type Increment struct {
+	Name     string
+	Counters map[string]int64
+	Seen     time.Time
+}
+
+// Store - Statistics of the domains and watermarks of the clusters
+type Store interface {
+	// Update - Run the function in a transaction, its increments and watermarks are saved together or not at all
+	Update(ctx context.Context, fn func(tx Tx) error) error
+	// Get - Retrieve a domain, ErrNotFound when it has never been seen
+	Get(ctx context.Context, name string) (*Domain, error)
+	// Get Many - Retrieve the domains found among the names, by name
+	GetMany(ctx context.Context, names []string) (map[string]*Domain, error)
+	// Watermark - Progress of a cluster, if any
+	Watermark(ctx context.Context, cluster string) (Watermark, bool, error)
+	Close() error
+}
+
+// Tx - Transaction of a store
+type Tx interface {
+	// Context - Context of the transaction, bound to the MongoDB session when the store is MongoDB
+	Context() context.Context
+	// Increment - Add the counters to the domains and keep the latest time they were seen
+	Increment(increments []Increment) error
+	// Watermark - Progress of a cluster, including the one set in the transaction
+	Watermark(cluster string) (Watermark, bool, error)
+	// Set Watermark - Save the progress of a cluster with a fencing token
+	// ErrFenced when the watermark was saved with a newer token
+	SetWatermark(cluster string, w Watermark, token int64) error
+}
+
+// Open - Open the store of the address : bolt:<path> for an embedded file, a MongoDB host and port otherwise
+// The in-memory store is not given by an address, the aggregator service and the web server being separate processes
+func Open(address string) (Store, error) {
+
+	if strings.HasPrefix(address, "bolt:") {
+		return OpenBolt(strings.TrimPrefix(address, "bolt:"), false)
+	}
+
+	return OpenMongo(address)
+}
+
+// Open Read Only - Open the store of the address to read it only
+// The embedded file is shared with the other read only opens, not with the aggregator service writing it
+func OpenReadOnly(address string) (Store, error) {
+
+	if strings.HasPrefix(address, "bolt:") {
+		return OpenBolt(strings.TrimPrefix(address, "bolt:"), true)
+	}
+
+	return OpenMongo(address)
+}
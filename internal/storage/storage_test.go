@@ -0,0 +1,158 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// The in-memory and bbolt stores behave the same
+func stores(t *testing.T) map[string]Store {
+	b, err := OpenBolt(filepath.Join(t.TempDir(), "catchall.db"), false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return map[string]Store{"memory": NewMemory(), "bolt": b}
+}
+
+func TestIncrement(t *testing.T) {
+	ctx := context.Background()
+	seen := time.Date(2021, 1, 1, 0, 0, 0, 0, time.UTC)
+
+	for name, s := range stores(t) {
+		for _, at := range []time.Time{seen, seen.Add(-time.Hour)} {
+			err := s.Update(ctx, func(tx Tx) error {
+				return tx.Increment([]Increment{
+					{Name: "example.com", Counters: map[string]int64{"delivered": 2, "opened": 1}, Seen: at},
+					{Name: "empty.com", Seen: at},
+				})
+			})
+			if err != nil {
+				t.Fatal(name, err)
+			}
+		}
+
+		d, err := s.Get(ctx, "example.com")
+		if err != nil {
+			t.Fatal(name, err)
+		}
+		if d.Counters["delivered"] != 4 || d.Counters["opened"] != 2 || !d.LastSeen.Equal(seen) {
+			t.Fatalf("%s: example.com %+v", name, d)
+		}
+		if _, err := s.Get(ctx, "empty.com"); err != ErrNotFound {
+			t.Fatalf("%s: domain without counters stored: %v", name, err)
+		}
+
+		found, err := s.GetMany(ctx, []string{"example.com", "unknown.com"})
+		if err != nil {
+			t.Fatal(name, err)
+		}
+		if len(found) != 1 || found["example.com"].Counters["delivered"] != 4 {
+			t.Fatalf("%s: found %v", name, found)
+		}
+	}
+}
+
+func TestUpdateRollback(t *testing.T) {
+	ctx := context.Background()
+	failure := errors.New("failure")
+
+	for name, s := range stores(t) {
+		err := s.Update(ctx, func(tx Tx) error {
+			tx.Increment([]Increment{{Name: "example.com", Counters: map[string]int64{"delivered": 1}}})
+			tx.SetWatermark("cluster", Watermark{Epoch: 1}, 1)
+			return failure
+		})
+		if err != failure {
+			t.Fatalf("%s: update returned %v", name, err)
+		}
+
+		if _, err := s.Get(ctx, "example.com"); err != ErrNotFound {
+			t.Fatalf("%s: increment of a failed transaction saved: %v", name, err)
+		}
+		if _, found, _ := s.Watermark(ctx, "cluster"); found {
+			t.Fatalf("%s: watermark of a failed transaction saved", name)
+		}
+	}
+}
+
+func TestWatermark(t *testing.T) {
+	ctx := context.Background()
+
+	for name, s := range stores(t) {
+		page := Watermark{Epoch: 4, Cursor: "example.com"}
+		err := s.Update(ctx, func(tx Tx) error {
+			if err := tx.SetWatermark("cluster", page, 2); err != nil {
+				return err
+			}
+			w, found, err := tx.Watermark("cluster")
+			if err != nil || !found || w != page {
+				t.Fatalf("%s: watermark in the transaction %+v %v %v", name, w, found, err)
+			}
+			return nil
+		})
+		if err != nil {
+			t.Fatal(name, err)
+		}
+
+		w, found, err := s.Watermark(ctx, "cluster")
+		if err != nil || !found || w != page {
+			t.Fatalf("%s: watermark %+v %v %v", name, w, found, err)
+		}
+
+		// A former holder of the lease can't commit anymore
+		err = s.Update(ctx, func(tx Tx) error {
+			return tx.SetWatermark("cluster", Watermark{Epoch: 5}, 1)
+		})
+		if err != ErrFenced {
+			t.Fatalf("%s: watermark with an older token: %v", name, err)
+		}
+
+		err = s.Update(ctx, func(tx Tx) error {
+			return tx.SetWatermark("cluster", Watermark{Epoch: 5}, 3)
+		})
+		if err != nil {
+			t.Fatal(name, err)
+		}
+		if w, _, _ := s.Watermark(ctx, "cluster"); w != (Watermark{Epoch: 5}) {
+			t.Fatalf("%s: watermark %+v", name, w)
+		}
+	}
+}
+
+func TestBoltReadOnly(t *testing.T) {
+	ctx := context.Background()
+	path := filepath.Join(t.TempDir(), "catchall.db")
+
+	b, err := OpenBolt(path, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = b.Update(ctx, func(tx Tx) error {
+		return tx.Increment([]Increment{{Name: "example.com", Counters: map[string]int64{"delivered": 1}}})
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	b.Close()
+
+	// The read only opens share the file
+	readers := make([]*Bolt, 2)
+	for i := range readers {
+		if readers[i], err = OpenBolt(path, true); err != nil {
+			t.Fatal(err)
+		}
+		defer readers[i].Close()
+	}
+
+	d, err := readers[1].Get(ctx, "example.com")
+	if err != nil || d.Counters["delivered"] != 1 {
+		t.Fatalf("domain %+v %v", d, err)
+	}
+	err = readers[0].Update(ctx, func(tx Tx) error { return nil })
+	if err == nil {
+		t.Fatal("update of a read only file")
+	}
+}